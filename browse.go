@@ -0,0 +1,292 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// browseMinInterval and browseMaxInterval bound the delay between the
+	// queries of a browse, which doubles after each query as per section
+	// 5.2 of RFC 6762
+	browseMinInterval = time.Second
+	browseMaxInterval = time.Hour
+
+	// browseSweepInterval is how often a browse checks for instances that
+	// have expired or need refreshing
+	browseSweepInterval = time.Second
+)
+
+// Browse continuously looks up a given service, in a domain, until the
+// context is cancelled, returning ctx.Err(). Entries are streamed to a
+// channel once complete, and again whenever their records change. Instances
+// that announce their departure or whose records expire are streamed to
+// the Removed channel, if provided. Sends will not block, so clients should
+// make sure to either read or buffer. The Timeout parameter is ignored.
+//
+// If every listener fails, such as when the network interface goes away, an
+// error wrapping ErrListenersFailed is returned so the caller can browse
+// again once the network is back.
+//
+// If RebindInterval is set, the network interfaces are polled at that
+// interval, and the browse is restarted on new listeners whenever they
+// change or the listeners fail, rather than returning. Entries that are
+// still present are streamed again after each restart.
+func Browse(ctx context.Context, params *QueryParam) error {
+	if params.Entries == nil {
+		return ErrNoEntriesChannel
+	}
+	if params.Logger == nil {
+		params.Logger = log.Default()
+	}
+	if params.RebindInterval > 0 {
+		return browseRebind(ctx, params)
+	}
+
+	// Create a new client
+	client, err := newClient(params)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Browse(ctx, params)
+}
+
+// Browse is the same as the package level Browse, however it uses the
+// listeners of the client. The client is busy until the browse returns.
+func (c *Client) Browse(ctx context.Context, params *QueryParam) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClientClosed
+	}
+	if params.Entries == nil {
+		return ErrNoEntriesChannel
+	}
+
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return err
+	}
+	return c.browse(ctx, params)
+}
+
+// browseRebind browses on a new client each time the network interfaces
+// change, or the listeners of the previous client fail
+func browseRebind(ctx context.Context, params *QueryParam) error {
+	// Catch mistakes in the parameters before binding, as they won't be
+	// fixed by rebinding
+	if params.Domain == "" {
+		params.Domain = "local"
+	}
+	if _, err := queryServices(params); err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		state := interfaceState()
+		client, err := newClient(params)
+		if err != nil {
+			params.Logger.Printf("[WARN] mdns: Failed to bind, retrying in %v: %v", params.RebindInterval, err)
+		} else {
+			var changed bool
+			changed, err = browseUntilChanged(ctx, client, params, state)
+			client.Close()
+			if changed {
+				params.Logger.Printf("[INFO] mdns: Network interfaces changed, rebinding")
+				continue
+			}
+			if !errors.Is(err, ErrListenersFailed) {
+				return err
+			}
+			params.Logger.Printf("[WARN] mdns: Browse failed, rebinding in %v: %v", params.RebindInterval, err)
+		}
+
+		select {
+		case <-time.After(params.RebindInterval):
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
+
+// browseUntilChanged browses on the client until the browse fails or the
+// network interfaces no longer match the given state, in which case true is
+// returned
+func browseUntilChanged(ctx context.Context, client *Client, params *QueryParam, state string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(params.RebindInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if interfaceState() != state {
+					close(changed)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := client.Browse(ctx, params)
+	select {
+	case <-changed:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// interfaceState summarizes the multicast interfaces that are up and their
+// addresses, so that changes to the network can be noticed. It is a
+// variable so tests can simulate changes.
+var interfaceState = func() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%d %s", iface.Index, iface.Name)
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			fmt.Fprintf(&b, " %s", addr)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// browseRecord tracks the lifetime of the pointer to a browsed instance
+type browseRecord struct {
+	ptr       *dns.PTR
+	received  time.Time
+	ttl       time.Duration
+	refreshed bool
+}
+
+// browseTTL returns the lifetime of a record, raised to the minimum if it
+// is shorter, so that devices advertising tiny TTLs aren't constantly
+// queried again. Goodbyes are handled before this, so still take effect
+// immediately.
+func browseTTL(ttl uint32, min time.Duration) time.Duration {
+	if d := time.Duration(ttl) * time.Second; d > min {
+		return d
+	}
+	return min
+}
+
+// browse is used to continuously query for a service and stream changes
+func (c *Client) browse(ctx context.Context, params *QueryParam) error {
+	services, err := queryServices(params)
+	if err != nil {
+		return err
+	}
+
+	// Listen until the browse is cancelled
+	msgCh, errCh, stop := c.startRecv(time.Time{}, newSourceFilter(params), params)
+	defer stop()
+
+	m := newServiceQuery(services, params)
+	a := newAssembler(services, params)
+	records := make(map[string]*browseRecord)
+
+	sweep := time.NewTicker(browseSweepInterval)
+	defer sweep.Stop()
+
+	queryCh := time.After(0)
+	interval := browseMinInterval
+	for {
+		select {
+		case <-queryCh:
+			if err := c.sendQuery(m, params); err != nil {
+				params.Logger.Printf("[ERR] mdns: Failed to send query: %v", err)
+			}
+			queryCh = time.After(interval)
+			if interval *= 2; interval > browseMaxInterval {
+				interval = browseMaxInterval
+			}
+
+		case pkt := <-msgCh:
+			sendRawMessage(params, pkt.msg)
+			if !pkt.msg.Response {
+				continue
+			}
+
+			// Track the lifetime of the pointers to each instance
+			now := time.Now()
+			for _, answer := range responseRecords(pkt.msg) {
+				ptr, ok := answer.(*dns.PTR)
+				if !ok || !a.matches(ptr) || ptr.Hdr.Ttl == 0 {
+					continue
+				}
+				records[nameKey(ptr.Ptr)] = &browseRecord{
+					ptr:      ptr,
+					received: now,
+					ttl:      browseTTL(ptr.Hdr.Ttl, params.MinTTL),
+				}
+			}
+
+			// The assembler only returns entries changed by new records,
+			// so stream every update
+			for _, inp := range a.handleResponse(pkt) {
+				c.emitEntry(params, inp, true)
+			}
+
+			// Stop tracking any instances that said goodbye
+			for name := range records {
+				if _, ok := a.inprogress[nameKey(name)]; !ok {
+					delete(records, name)
+				}
+			}
+
+		case now := <-sweep.C:
+			refresh := false
+			for name, rec := range records {
+				switch {
+				case now.Sub(rec.received) >= rec.ttl:
+					// The instance has expired
+					delete(records, name)
+					a.remove(rec.ptr)
+				case !rec.refreshed && now.Sub(rec.received) >= rec.ttl*8/10:
+					// Query again at 80% of the TTL, as per section 5.2
+					rec.refreshed = true
+					refresh = true
+				}
+			}
+			if refresh {
+				if err := c.sendQuery(m, params); err != nil {
+					params.Logger.Printf("[ERR] mdns: Failed to refresh query: %v", err)
+				}
+			}
+
+		case err := <-errCh:
+			// Every listener has failed, so nothing more will be received
+			return err
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBrowse(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_browse._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_browse._tcp",
+		Domain:  "local",
+		Entries: entries,
+	}
+	if err := Browse(ctx, params); err != context.DeadlineExceeded {
+		t.Fatalf("expected the browse to run until the deadline, got: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if e := <-entries; e.Name != "hostname._browse._tcp.local." {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestBrowse_NoEntriesChannel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	params := &QueryParam{Service: "_nochan._tcp", Domain: "local"}
+	if err := Browse(ctx, params); err != ErrNoEntriesChannel {
+		t.Fatalf("expected ErrNoEntriesChannel, got: %v", err)
+	}
+
+	c := newClientWithPacketConns(newMemConn(func([]byte) []byte { return nil }), nil)
+	defer c.Close()
+	if err := c.Browse(ctx, params); err != ErrNoEntriesChannel {
+		t.Fatalf("expected ErrNoEntriesChannel from the client, got: %v", err)
+	}
+}
+
+func TestBrowse_Removed(t *testing.T) {
+	zone := &goodbyeZone{Zone: makeServiceWithServiceName(t, "_browsegone._tcp")}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	removed := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_browsegone._tcp",
+		Domain:  "local",
+		Entries: make(chan *ServiceEntry, 4),
+		Removed: removed,
+	}
+	Browse(ctx, params)
+
+	select {
+	case e := <-removed:
+		if e.Name != "hostname._browsegone._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("expected a removal notification")
+	}
+}
+
+func TestBrowse_ServerShutdown(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_browseshut._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry, 4)
+	removed := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_browseshut._tcp",
+		Domain:  "local",
+		Entries: entries,
+		Removed: removed,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Browse(ctx, params)
+	}()
+
+	select {
+	case <-entries:
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for the entry")
+	}
+	serv.Shutdown()
+
+	select {
+	case e := <-removed:
+		if e.Name != "hostname._browseshut._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for the goodbye")
+	}
+	cancel()
+	<-errCh
+}
+
+func TestBrowse_ListenersFailed(t *testing.T) {
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(l, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Browse(context.Background(), &QueryParam{
+			Service: "_failed._tcp",
+			Domain:  "local",
+			Entries: make(chan *ServiceEntry, 4),
+		})
+	}()
+
+	// Close the listener out from under the client, as happens when the
+	// interface goes away
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrListenersFailed) {
+			t.Fatalf("expected ErrListenersFailed, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("browse did not return after its listeners failed")
+	}
+}
+
+func TestBrowse_Rebind(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_rebind._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	// Report a different network each time the interfaces are polled
+	var polls int32
+	old := interfaceState
+	interfaceState = func() string {
+		return fmt.Sprint(atomic.AddInt32(&polls, 1))
+	}
+	defer func() { interfaceState = old }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry, 16)
+	params := &QueryParam{
+		Service:        "_rebind._tcp",
+		Domain:         "local",
+		Entries:        entries,
+		RebindInterval: 50 * time.Millisecond,
+	}
+	if err := Browse(ctx, params); err != context.DeadlineExceeded {
+		t.Fatalf("expected the browse to run until the deadline, got: %v", err)
+	}
+
+	// The entry should be found again on the new listeners after each change
+	if len(entries) < 2 {
+		t.Fatalf("expected the entry to be found after rebinding, got %d entries", len(entries))
+	}
+	if atomic.LoadInt32(&polls) < 2 {
+		t.Fatalf("expected the interfaces to be polled")
+	}
+}
+
+func TestBrowseTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttl  uint32
+		min  time.Duration
+		want time.Duration
+	}{
+		{120, 0, 120 * time.Second},
+		{10, time.Minute, time.Minute},
+		{120, time.Minute, 120 * time.Second},
+	} {
+		if got := browseTTL(test.ttl, test.min); got != test.want {
+			t.Fatalf("browseTTL(%d, %v) = %v, want %v", test.ttl, test.min, got, test.want)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package mdns
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,6 +19,75 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
+const (
+	// recvMinBackoff and recvMaxBackoff bound the delay between retries
+	// when reading from a listener fails temporarily.
+	recvMinBackoff = 5 * time.Millisecond
+	recvMaxBackoff = time.Second
+
+	// maxQueryRetries caps the number of times a query is sent
+	maxQueryRetries = 8
+
+	// cooperativeMinDelay and cooperativeMaxDelay bound the delay before a
+	// cooperative query is sent, per section 5.2 of RFC 6762
+	cooperativeMinDelay = 20 * time.Millisecond
+	cooperativeMaxDelay = 120 * time.Millisecond
+
+	// defaultMulticastHops is the TTL of multicast queries, matching the
+	// 255 section 11 of RFC 6762 recommends for responses
+	defaultMulticastHops = 255
+
+	// defaultInitialDelay is the longest delay before the first query made
+	// with DefaultParams, which gives the 20-120ms of section 5.2 of RFC
+	// 6762
+	defaultInitialDelay = 120 * time.Millisecond
+
+	// defaultRecvBufferSize is the largest UDP payload, though mDNS
+	// packets rarely exceed the size of an Ethernet frame
+	defaultRecvBufferSize = 65536
+
+	// defaultMaxPacketRate is the number of packets each listener handles
+	// per second before dropping the excess, which is far beyond the
+	// traffic of a normal network
+	defaultMaxPacketRate = 5000
+
+	// defaultEntriesBuffer is the capacity of the Entries channel made by
+	// DefaultParams, matching the queue of received packets
+	defaultEntriesBuffer = 32
+)
+
+// ErrInvalidServiceName is returned when the service, subtype and domain
+// being queried or advertised don't form a valid domain name
+var ErrInvalidServiceName = errors.New("invalid service name")
+
+// ErrNoEntriesChannel is returned when querying without an Entries channel
+// to stream the results to
+var ErrNoEntriesChannel = errors.New("no entries channel")
+
+// ErrListenersFailed is returned by a browse when every listener has failed,
+// for example because the network interface went away. The client should be
+// closed and a new one created once the network is back.
+var ErrListenersFailed = errors.New("all listeners failed")
+
+// ErrClientClosed is returned when querying with a client that is closed
+var ErrClientClosed = errors.New("client is closed")
+
+// ErrBindFailed is matched by the errors returned when the listeners a
+// client or server needs can't be bound, such as when there is no network.
+// Use errors.As with BindErrors for the failures of each listener.
+var ErrBindFailed = errors.New("failed to bind")
+
+// ErrInvalidParam is wrapped by the errors returned for query parameters,
+// or other arguments, that are out of range or conflict with each other
+var ErrInvalidParam = errors.New("invalid query parameter")
+
+// ErrNotFound is wrapped by the errors returned by lookups that find
+// nothing by their timeout, such as ResolveService, ResolveHost and
+// ReverseLookup, and for interfaces that don't exist. As nothing answering
+// is the only way a lookup times out, there is no separate timeout error.
+// Queries streaming entries return nil when they find none.
+var ErrNotFound = errors.New("not found")
+
 // ServiceEntry is returned after we query for a service
 type ServiceEntry struct {
 	Name       string
@@ -20,37 +95,243 @@ type ServiceEntry struct {
 	AddrV4     net.IP
 	AddrV6     net.IP
 	Port       int
+	Priority   int
+	Weight     int
 	Info       string
 	InfoFields []string
 
-	Addr net.IP // @Deprecated
+	// Addr is the first address seen for the entry, of either family.
+	//
+	// Deprecated: use AddrV4 or AddrV6.
+	Addr net.IP
+
+	Iface       *net.Interface // Interface the entry was received on, if known
+	SrcAddr     net.IP         // Address of the responder
+	Unicast     bool           // Whether the last response updating the entry was sent to the client directly, rather than to the group, if known
+	Partial     bool           // Whether the entry is still missing records, only streamed with EmitPartial
+	ServiceType string         // Service type that was queried, such as "_http._tcp"
+	Domain      string         // Domain that was queried, such as "local"
+
+	// AddrV6Zone is the zone of AddrV6 when it is link local, which is the
+	// name of the interface it was received on. The address can only be
+	// reached through that interface.
+	AddrV6Zone string
 
 	hasTXT bool
+	noTXT  bool // An NSEC record said the instance has no TXT record
 	sent   bool
 }
 
-// complete is used to check if we have all the info we need
+// TXTMap parses the TXT strings of the entry as DNS-SD key/value pairs,
+// as described in section 6 of RFC 6763. Keys are case-insensitive, so are
+// returned in lower case. A boolean attribute (a string with no "=") maps
+// to the empty string. Only the first occurrence of a key is used, and
+// strings with an empty key are ignored.
+func (s *ServiceEntry) TXTMap() map[string]string {
+	m := make(map[string]string, len(s.InfoFields))
+	for _, field := range s.InfoFields {
+		key, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		if key == "" {
+			continue
+		}
+		key = strings.ToLower(key)
+		if _, ok := m[key]; ok {
+			continue
+		}
+		m[key] = value
+	}
+	return m
+}
+
+// AddrV6Host returns AddrV6 in a form that can be dialed, including the
+// zone of a link local address (e.g. "fe80::1%eth0"). It returns the empty
+// string if the entry has no IPv6 address.
+func (s *ServiceEntry) AddrV6Host() string {
+	if s.AddrV6 == nil {
+		return ""
+	}
+	return (&net.IPAddr{IP: s.AddrV6, Zone: s.AddrV6Zone}).String()
+}
+
+// PreferredAddr returns the address to dial, chosen as a dual stack host
+// would by default under RFC 6724. The IPv6 address is preferred if it is
+// global, and this host has a global IPv6 address of its own to reach it
+// from. Otherwise the IPv4 address is preferred, as IPv4 takes precedence
+// over unique local and link local IPv6 addresses, falling back to the IPv6
+// address if there is no IPv4 address. A link local IPv6 address can only be
+// dialed with its zone, see AddrV6Host. Returns nil if the entry has no
+// addresses.
+func (s *ServiceEntry) PreferredAddr() net.IP {
+	return s.preferredAddr(hasGlobalIPv6())
+}
+
+// preferredAddr returns the address to dial, given whether this host has a
+// global IPv6 address
+func (s *ServiceEntry) preferredAddr(globalV6 bool) net.IP {
+	if globalV6 && isGlobalIPv6(s.AddrV6) {
+		return s.AddrV6
+	}
+	if s.AddrV4 != nil {
+		return s.AddrV4
+	}
+	return s.AddrV6
+}
+
+// isGlobalIPv6 returns whether ip is a global IPv6 address, excluding
+// unique local addresses (fc00::/7)
+func isGlobalIPv6(ip net.IP) bool {
+	if ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return false
+	}
+	return ip[0]&0xfe != 0xfc
+}
+
+// hasGlobalIPv6 returns whether any interface of this host has a global
+// IPv6 address
+func hasGlobalIPv6() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && isGlobalIPv6(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// complete is used to check if we have all the info we need. An address of
+// either family is sufficient, and the TXT record isn't needed if it is
+// known not to exist.
 func (s *ServiceEntry) complete() bool {
-	return (s.AddrV4 != nil || s.AddrV6 != nil || s.Addr != nil) && s.Port != 0 && s.hasTXT
+	return (s.AddrV4 != nil || s.AddrV6 != nil || s.Addr != nil) && s.Port != 0 && (s.hasTXT || s.noTXT)
+}
+
+// completeFor checks if the entry has the records a query of the type is
+// for, which for a TXT query are only its TXT records
+func (s *ServiceEntry) completeFor(qtype uint16) bool {
+	if qtype == dns.TypeTXT {
+		return s.hasTXT
+	}
+	return s.complete()
 }
 
 // QueryParam is used to customize how a Lookup is performed
 type QueryParam struct {
-	Service             string               // Service to lookup
-	Domain              string               // Lookup domain, default "local"
-	Timeout             time.Duration        // Lookup timeout, default 1 second
-	Interface           *net.Interface       // Multicast interface to use
-	Entries             chan<- *ServiceEntry // Entries Channel
-	WantUnicastResponse bool                 // Unicast response desired, as per 5.4 in RFC
+	Service                string               // Service to lookup
+	Services               []string             // Additional services to look up in the same query, each entry recording the one it matched
+	Domain                 string               // Lookup domain, default "local"
+	Timeout                time.Duration        // Lookup timeout, default 1 second
+	Interface              *net.Interface       // Multicast interface to use
+	InterfaceName          string               // Name of the multicast interface to use, if Interface is not set
+	InterfaceIndex         int                  // Index of the multicast interface to use, if Interface and InterfaceName are not set
+	Entries                chan<- *ServiceEntry // Entries Channel
+	WantUnicastResponse    bool                 // Unicast response desired, as per 5.4 in RFC
+	Retries                int                  // Number of times the query is sent within the timeout, default 1
+	AllowDuplicates        bool                 // Stream an entry each time its records are received, rather than once
+	Removed                chan<- *ServiceEntry // Optional channel notified of instances announcing their departure
+	MaxEntries             int                  // Return once this many distinct complete entries are found, 0 for no limit
+	Logger                 *log.Logger          // Logger for diagnostics, defaults to the standard logger
+	UnicastAddr            *net.UDPAddr         // Send the query directly to this responder from an ephemeral port, rather than multicasting it
+	Subtype                string               // Optional subtype to narrow the lookup to, such as "_printer"
+	ResolveInstance        string               // Optional instance name to resolve directly, returning once it is complete
+	RecvBufferSize         int                  // Size of the buffer each packet is read into, default 65536
+	RawMessages            chan<- *dns.Msg      // Optional channel receiving a copy of each response, for fields not modeled by ServiceEntry
+	AllowRemoteResponses   bool                 // Accept responses from sources off the local link, such as for unicast DNS-SD
+	IPv4Group              *net.UDPAddr         // IPv4 multicast group and port to use, default 224.0.0.251:5353
+	IPv6Group              *net.UDPAddr         // IPv6 multicast group and port to use, default [ff02::fb]:5353
+	EmitPartial            bool                 // Also stream entries each time they are updated before they are complete, marked Partial
+	LocalAddr              net.IP               // Local address to send queries from, rather than letting the system choose
+	UDPSize                uint16               // UDP payload size advertised with EDNS0 when over 512, which should not exceed RecvBufferSize
+	RebindInterval         time.Duration        // Poll the network interfaces this often during a package level Browse, rebinding when they change
+	QueryClass             uint16               // Class of the questions asked, default dns.ClassINET
+	QueryType              uint16               // Records the query is for, either dns.TypePTR for complete entries (the default) or dns.TypeTXT to stream entries as soon as their TXT records arrive
+	QueryTypes             []uint16             // Types of record asked for, one question each, default PTR for a service and SRV and TXT for an instance; answers of other types are ignored, except those entries are built from
+	MinTTL                 time.Duration        // Minimum lifetime of the records tracked by a Browse, raising shorter TTLs when scheduling refreshes
+	Match                  func(dns.RR) bool    // Optional filter of the response records used, replacing the check that pointers are for the service queried
+	Stats                  *Stats               // Optional counters of the traffic of the query, for diagnostics
+	OnPacket               OnPacketFunc         // Optional callback for each packet received, see OnPacketFunc
+	Cooperative            bool                 // Skip sending the query if another host asks the same question first, sharing its responses
+	NoFilter               bool                 // Use every record of every response, streaming each entry they update as is, such as for a sniffer
+	PerInterface           bool                 // Assemble the responses received on each interface separately, streaming an entry per interface an instance answers on
+	InitialDelay           time.Duration        // Longest random delay before the query is first sent, within the timeout, to avoid colliding with hosts starting together
+	SourcePort             int                  // Port to send queries from when the client binds its listeners, such as 5353 for networks that require it, default an ephemeral port
+	MulticastLoopback      *bool                // Whether queries sent are looped back to this host's responders, rather than the platform's default
+	MulticastHops          int                  // IPv4 TTL and IPv6 hop limit of the multicast queries sent, between 1 and 255, default 255
+	MaxPacketRate          int                  // Packets handled per second by each listener before the excess is dropped, default 5000, negative for no limit
+	DrainAfterLastResponse time.Duration        // Keep listening at least this long after each response, past the timeout, for late responders
+	MaxTimeout             time.Duration        // Longest a query can keep listening when extended by DrainAfterLastResponse, default 3 times the timeout
+	ListenConfig           *net.ListenConfig    // Optional config the client's listeners are bound with, such as to set socket options in its Control
+	StrictSRVTarget        bool                 // Only take an instance's addresses from the records of its service record's target, asking for them if missing
+	DisableIPv4            bool                 // Whether to disable usage of IPv4 for MDNS operations. Does not affect discovered addresses.
+	DisableIPv6            bool                 // Whether to disable usage of IPv6 for MDNS operations. Does not affect discovered addresses.
 }
 
-// DefaultParams is used to return a default set of QueryParam's
+// OnPacketFunc is called with each packet received by a query, with the
+// result of unpacking it. Packets from sources that aren't accepted and
+// copies of the client's own queries are dropped before it is called. It is
+// called on the receive goroutine, so must not block: heavy work should be
+// handed off elsewhere. The data is only valid until it returns.
+type OnPacketFunc func(src net.Addr, data []byte, err error)
+
+// Stats counts the traffic of queries, to help diagnose queries that find
+// nothing. The counters are added to atomically while a query runs, so
+// should only be read once it returns.
+type Stats struct {
+	QueriesSentV4   uint64 // Queries sent over IPv4
+	QueriesSentV6   uint64 // Queries sent over IPv6
+	BytesSent       uint64 // Bytes of queries sent
+	SendFailures    uint64 // Queries that could not be sent over a family, including those sent over the other
+	PacketsReceived uint64 // Packets received, including those then ignored
+	PacketsDropped  uint64 // Packets received over the MaxPacketRate, which were not unpacked
+	ParseFailures   uint64 // Packets received that could not be unpacked
+	RecordsMatched  uint64 // Response records applied to the entries of a query
+	EntriesDropped  uint64 // Entries not streamed because the Entries or Removed channel was full
+}
+
+// countDropped records an entry that could not be streamed
+func (s *Stats) countDropped() {
+	if s != nil {
+		atomic.AddUint64(&s.EntriesDropped, 1)
+	}
+}
+
+// countSendFailure records a query that could not be sent over a family
+func (s *Stats) countSendFailure() {
+	if s != nil {
+		atomic.AddUint64(&s.SendFailures, 1)
+	}
+}
+
+// countSent records a query sent over a family
+func (s *Stats) countSent(v4 bool, n int) {
+	if s == nil {
+		return
+	}
+	if v4 {
+		atomic.AddUint64(&s.QueriesSentV4, 1)
+	} else {
+		atomic.AddUint64(&s.QueriesSentV6, 1)
+	}
+	atomic.AddUint64(&s.BytesSent, uint64(n))
+}
+
+// DefaultParams is used to return a default set of QueryParam's. Entries
+// are sent without blocking, and dropped if the channel is full, so the
+// default channel is buffered to hold the entries of a typical network
+// until they are read. The query is first sent after a short random delay,
+// which can be zeroed for a quicker single resolve.
 func DefaultParams(service string) *QueryParam {
 	return &QueryParam{
 		Service:             service,
 		Domain:              "local",
 		Timeout:             time.Second,
-		Entries:             make(chan *ServiceEntry),
+		Entries:             make(chan *ServiceEntry, defaultEntriesBuffer),
+		InitialDelay:        defaultInitialDelay,
 		WantUnicastResponse: false, // TODO(reddaly): Change this default.
 	}
 }
@@ -58,32 +339,49 @@ func DefaultParams(service string) *QueryParam {
 // Query looks up a given service, in a domain, waiting at most
 // for a timeout before finishing the query. The results are streamed
 // to a channel. Sends will not block, so clients should make sure to
-// either read or buffer.
+// either read or buffer. Entries that don't fit in the channel are
+// dropped, which is counted in the Stats parameter if set.
 func Query(params *QueryParam) error {
+	return QueryContext(context.Background(), params)
+}
+
+// QueryContext looks up a given service, in a domain, waiting at most
+// for a timeout before finishing the query. The results are streamed
+// to a channel. Sends will not block, so clients should make sure to
+// either read or buffer. QueryContext will stop the query and return
+// ctx.Err() if the context is cancelled. If the context has a deadline
+// sooner than the timeout, the query ends at that deadline instead, and
+// context.DeadlineExceeded is returned. A context that is already done
+// returns before any sockets are bound.
+func QueryContext(ctx context.Context, params *QueryParam) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if params.Entries == nil {
+		return ErrNoEntriesChannel
+	}
+	if params.Logger == nil {
+		params.Logger = log.Default()
+	}
+
 	// Create a new client
-	client, err := newClient()
+	client, err := newClient(params)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	// Set the multicast interface
-	if params.Interface != nil {
-		if err := client.setInterface(params.Interface); err != nil {
-			return err
+	// Tear down the client if the context is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-client.closedCh:
 		}
-	}
-
-	// Ensure defaults are set
-	if params.Domain == "" {
-		params.Domain = "local"
-	}
-	if params.Timeout == 0 {
-		params.Timeout = time.Second
-	}
+	}()
 
 	// Run the query
-	return client.query(params)
+	return client.QueryContext(ctx, params)
 }
 
 // Lookup is the same as Query, however it uses all the default parameters
@@ -93,279 +391,2552 @@ func Lookup(service string, entries chan<- *ServiceEntry) error {
 	return Query(params)
 }
 
-// Client provides a query interface that can be used to
-// search for service providers using mDNS
-type client struct {
-	ipv4UnicastConn *net.UDPConn
-	ipv6UnicastConn *net.UDPConn
-
-	ipv4MulticastConn *net.UDPConn
-	ipv6MulticastConn *net.UDPConn
+// Lookup4 is the same as Lookup, however only IPv4 is used to query
+func Lookup4(service string, entries chan<- *ServiceEntry) error {
+	params := DefaultParams(service)
+	params.Entries = entries
+	params.DisableIPv6 = true
+	return Query(params)
+}
 
-	closed   int32
-	closedCh chan struct{} // TODO(reddaly): This doesn't appear to be used.
+// Lookup6 is the same as Lookup, however only IPv6 is used to query
+func Lookup6(service string, entries chan<- *ServiceEntry) error {
+	params := DefaultParams(service)
+	params.Entries = entries
+	params.DisableIPv4 = true
+	return Query(params)
 }
 
-// NewClient creates a new mdns Client that can be used to query
-// for records
-func newClient() (*client, error) {
-	// TODO(reddaly): At least attempt to bind to the port required in the spec.
-	// Create a IPv4 listener
-	uconn4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+// QueryAll is the same as Query, however rather than streaming entries it
+// waits for the query to finish and returns the complete entries found,
+// one per instance, or per instance and interface if PerInterface is set.
+// The Entries and EmitPartial parameters are ignored.
+func QueryAll(params *QueryParam) ([]*ServiceEntry, error) {
+	p := *params
+	entriesCh := make(chan *ServiceEntry, 16)
+	p.Entries = entriesCh
+	p.EmitPartial = false
+
+	// Drain the channel while the query runs, keeping the latest entry
+	// seen for each instance
+	var entries []*ServiceEntry
+	index := make(map[string]int)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for e := range entriesCh {
+			key := e.Name
+			if p.PerInterface && e.Iface != nil {
+				key += "%" + e.Iface.Name
+			}
+			if i, ok := index[key]; ok {
+				entries[i] = e
+				continue
+			}
+			index[key] = len(entries)
+			entries = append(entries, e)
+		}
+	}()
+
+	err := Query(&p)
+	close(entriesCh)
+	<-doneCh
 	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListServiceTypes uses the DNS-SD service type enumeration meta-query to
+// list each type of service advertised in the "local" domain, waiting at
+// most for a timeout. The types are returned without the domain (e.g.
+// "_http._tcp"), ready to be passed to Lookup. The multicast interface is
+// the system default if iface is nil.
+func ListServiceTypes(timeout time.Duration, iface *net.Interface) ([]string, error) {
+	params := &QueryParam{
+		Domain:    "local",
+		Timeout:   timeout,
+		Interface: iface,
 	}
-	uconn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
+	client, err := newClient(params)
 	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
+		return nil, err
 	}
+	defer client.Close()
 
-	if uconn4 == nil && uconn6 == nil {
-		return nil, fmt.Errorf("failed to bind to any unicast udp port")
-	}
+	return client.listServiceTypes(context.Background(), params)
+}
 
-	mconn4, err := net.ListenMulticastUDP("udp4", nil, ipv4Addr)
-	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+// ResolveHost looks up the addresses of a host name, such as
+// "myhost.local", waiting at most for a timeout. An error wrapping
+// ErrNotFound is returned if no addresses are found by the timeout. The
+// multicast interface is the system default if iface is nil.
+func ResolveHost(name string, timeout time.Duration, iface *net.Interface) ([]net.IP, error) {
+	params := &QueryParam{
+		Timeout:   timeout,
+		Interface: iface,
 	}
-	mconn6, err := net.ListenMulticastUDP("udp6", nil, ipv6Addr)
+	client, err := newClient(params)
 	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
-	}
-
-	if mconn4 == nil && mconn6 == nil {
-		return nil, fmt.Errorf("failed to bind to any multicast udp port")
+		return nil, err
 	}
+	defer client.Close()
 
-	c := &client{
-		ipv4MulticastConn: mconn4,
-		ipv6MulticastConn: mconn6,
-		ipv4UnicastConn:   uconn4,
-		ipv6UnicastConn:   uconn6,
-		closedCh:          make(chan struct{}),
-	}
-	return c, nil
+	return client.resolveHost(context.Background(), name, params)
 }
 
-// Close is used to cleanup the client
-func (c *client) Close() error {
-	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
-		// something else already closed it
-		return nil
+// ResolveService looks up the records of a single instance of a service,
+// in a domain, such as one whose pointer was found by an earlier Browse,
+// waiting at most for a timeout. It returns as soon as the instance's entry
+// is complete, or an error if it isn't by the timeout. The domain defaults
+// to "local", and the multicast interface is the system default if iface is
+// nil.
+func ResolveService(instance, service, domain string, timeout time.Duration, iface *net.Interface) (*ServiceEntry, error) {
+	entries := make(chan *ServiceEntry, 1)
+	params := &QueryParam{
+		Service:         service,
+		Domain:          domain,
+		Timeout:         timeout,
+		Interface:       iface,
+		Entries:         entries,
+		ResolveInstance: instance,
 	}
-
-	log.Printf("[INFO] mdns: Closing client %v", *c)
-	close(c.closedCh)
-
-	if c.ipv4UnicastConn != nil {
-		c.ipv4UnicastConn.Close()
+	if err := Query(params); err != nil {
+		return nil, err
 	}
-	if c.ipv6UnicastConn != nil {
-		c.ipv6UnicastConn.Close()
+	select {
+	case e := <-entries:
+		return e, nil
+	default:
+		return nil, fmt.Errorf("%w: instance %q of %s", ErrNotFound, instance, service)
 	}
-	if c.ipv4MulticastConn != nil {
-		c.ipv4MulticastConn.Close()
+}
+
+// ReverseLookup looks up the host name of an IPv4 or IPv6 address, such as
+// "myhost.local.", with a reverse mapping query, waiting at most for a
+// timeout. The multicast interface is the system default if iface is nil.
+func ReverseLookup(ip net.IP, timeout time.Duration, iface *net.Interface) (string, error) {
+	params := &QueryParam{
+		Timeout:   timeout,
+		Interface: iface,
 	}
-	if c.ipv6MulticastConn != nil {
-		c.ipv6MulticastConn.Close()
+	client, err := newClient(params)
+	if err != nil {
+		return "", err
 	}
+	defer client.Close()
 
-	return nil
+	return client.reverseLookup(context.Background(), ip, params)
 }
 
-// setInterface is used to set the query interface, uses system
-// default if not provided
-func (c *client) setInterface(iface *net.Interface) error {
-	p := ipv4.NewPacketConn(c.ipv4UnicastConn)
-	if err := p.SetMulticastInterface(iface); err != nil {
-		return err
-	}
-	p2 := ipv6.NewPacketConn(c.ipv6UnicastConn)
-	if err := p2.SetMulticastInterface(iface); err != nil {
-		return err
-	}
-	p = ipv4.NewPacketConn(c.ipv4MulticastConn)
-	if err := p.SetMulticastInterface(iface); err != nil {
-		return err
-	}
-	p2 = ipv6.NewPacketConn(c.ipv6MulticastConn)
-	if err := p2.SetMulticastInterface(iface); err != nil {
-		return err
-	}
-	return nil
+// Client provides a query interface that can be used to
+// search for service providers using mDNS. A Client binds its listeners
+// once, and can be reused for many queries until it is closed.
+//
+// A Client is safe for concurrent use, however queries are serialized:
+// overlapping calls to Query will wait for the in-flight query to finish.
+type Client struct {
+	ipv4UnicastConn packetConn
+	ipv6UnicastConn packetConn
+
+	ipv4MulticastConn packetConn
+	ipv6MulticastConn packetConn
+
+	// ipv4Group and ipv6Group are the multicast groups queries are sent to
+	ipv4Group *net.UDPAddr
+	ipv6Group *net.UDPAddr
+
+	logger *log.Logger
+
+	// bindErrs holds the failures to bind any of the listeners
+	bindErrs BindErrors
+
+	// bufPool holds the buffers packets are read into, which are reused
+	// across queries
+	bufPool *sync.Pool
+
+	// sent holds the queries sent since receiving last started, guarded
+	// by sentLock
+	sentLock sync.Mutex
+	sent     map[string]struct{}
+
+	// queryLock ensures a single query is using the listeners at a time
+	queryLock sync.Mutex
+
+	// rand jitters the retransmissions of queries, guarded by queryLock.
+	// Each client has its own source so that tests can seed it.
+	rand *rand.Rand
+
+	// ifaceSet is whether a query set the multicast interface, and
+	// loopback holds the multicast loopback of each listener from before a
+	// query first set it, so that later queries that don't set them go
+	// back to the defaults. Both are guarded by queryLock.
+	ifaceSet bool
+	loopback []savedLoopback
+
+	// cancel stops the query in progress, guarded by cancelLock
+	cancelLock sync.Mutex
+	cancel     context.CancelFunc
+
+	closed   int32
+	closedCh chan struct{}
 }
 
-// query is used to perform a lookup and stream results
-func (c *client) query(params *QueryParam) error {
-	// Create the service name
-	serviceAddr := fmt.Sprintf("%s.%s.", trimDot(params.Service), trimDot(params.Domain))
-
-	// Start listening for response packets
-	msgCh := make(chan *dns.Msg, 32)
-	go c.recv(c.ipv4UnicastConn, msgCh)
-	go c.recv(c.ipv6UnicastConn, msgCh)
-	go c.recv(c.ipv4MulticastConn, msgCh)
-	go c.recv(c.ipv6MulticastConn, msgCh)
-
-	// Send the query
-	m := new(dns.Msg)
-	m.SetQuestion(serviceAddr, dns.TypePTR)
-	// RFC 6762, section 18.12.  Repurposing of Top Bit of qclass in Question
-	// Section
-	//
-	// In the Question Section of a Multicast DNS query, the top bit of the qclass
-	// field is used to indicate that unicast responses are preferred for this
-	// particular question.  (See Section 5.4.)
-	if params.WantUnicastResponse {
-		m.Question[0].Qclass |= 1 << 15
+// BindError describes a listener the client failed to bind
+type BindError struct {
+	Network   string // "udp4" or "udp6"
+	Multicast bool   // Whether the listener is the multicast one, rather than unicast
+	Err       error
+}
+
+func (e *BindError) Error() string {
+	kind := "unicast"
+	if e.Multicast {
+		kind = "multicast"
 	}
-	m.RecursionDesired = false
-	if err := c.sendQuery(m); err != nil {
-		return err
+	return fmt.Sprintf("failed to bind %s %s listener: %v", e.Network, kind, e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrBindFailed, as well as the cause through Unwrap
+func (e *BindError) Is(target error) bool {
+	return target == ErrBindFailed
+}
+
+// BindErrors lists the listeners the client failed to bind. It is returned
+// when creating a client if no unicast, or no multicast, listener could be
+// bound.
+type BindErrors []*BindError
+
+func (e BindErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "; ")
+}
 
-	// Map the in-progress responses
-	inprogress := make(map[string]*ServiceEntry)
+// Is matches ErrBindFailed
+func (e BindErrors) Is(target error) bool {
+	return target == ErrBindFailed
+}
 
-	// Listen until we reach the timeout
-	finish := time.After(params.Timeout)
-	for {
-		select {
-		case resp := <-msgCh:
-			var inp *ServiceEntry
-			for _, answer := range append(resp.Answer, resp.Extra...) {
-				// TODO(reddaly): Check that response corresponds to serviceAddr?
-				switch rr := answer.(type) {
-				case *dns.PTR:
-					// Create new entry for this
-					inp = ensureName(inprogress, rr.Ptr)
-
-				case *dns.SRV:
-					// Check for a target mismatch
-					if rr.Target != rr.Hdr.Name {
-						alias(inprogress, rr.Hdr.Name, rr.Target)
-					}
-
-					// Get the port
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Host = rr.Target
-					inp.Port = int(rr.Port)
-
-				case *dns.TXT:
-					// Pull out the txt
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Info = strings.Join(rr.Txt, "|")
-					inp.InfoFields = rr.Txt
-					inp.hasTXT = true
+// BindErrors returns the listeners that failed to bind when the client was
+// created. The client still works with the others, but may miss responders
+// only reachable through the missing ones.
+func (c *Client) BindErrors() BindErrors {
+	return c.bindErrs
+}
 
-				case *dns.A:
-					// Pull out the IP
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Addr = rr.A // @Deprecated
-					inp.AddrV4 = rr.A
+// Membership describes whether a client's multicast listener of a family
+// joined its group, and on which interfaces
+type Membership struct {
+	Network string          // "udp4" or "udp6"
+	Group   *net.UDPAddr    // Multicast group listened on
+	Bound   bool            // Whether the multicast listener is bound
+	Ifaces  []net.Interface // Interfaces the group is joined on
+}
 
-				case *dns.AAAA:
-					// Pull out the IP
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Addr = rr.AAAA // @Deprecated
-					inp.AddrV6 = rr.AAAA
-				}
-			}
+// Memberships reports the multicast group membership of each family, to
+// help debug clients that bind fine but never receive any responses, such
+// as when a platform silently fails to join the group on the expected
+// interface. As the host tracks memberships by interface rather than by
+// listener, an interface is also listed if only another process, such as
+// the system responder, has joined the group on it.
+func (c *Client) Memberships() ([]Membership, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
 
-			if inp == nil {
+	memberships := []Membership{
+		{Network: "udp4", Group: c.ipv4Group, Bound: c.ipv4MulticastConn != nil},
+		{Network: "udp6", Group: c.ipv6Group, Bound: c.ipv6MulticastConn != nil},
+	}
+	for i := range memberships {
+		m := &memberships[i]
+		if !m.Bound {
+			continue
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 {
 				continue
 			}
-
-			// Check if this entry is complete
-			if inp.complete() {
-				if inp.sent {
-					continue
-				}
-				inp.sent = true
-				select {
-				case params.Entries <- inp:
-				default:
-				}
-			} else {
-				// Fire off a node specific query
-				m := new(dns.Msg)
-				m.SetQuestion(inp.Name, dns.TypePTR)
-				m.RecursionDesired = false
-				if err := c.sendQuery(m); err != nil {
-					log.Printf("[ERR] mdns: Failed to query instance %s: %v", inp.Name, err)
+			addrs, err := iface.MulticastAddrs()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list multicast addresses of %s: %v", iface.Name, err)
+			}
+			for _, addr := range addrs {
+				if ipAddr, ok := addr.(*net.IPAddr); ok && ipAddr.IP.Equal(m.Group.IP) {
+					m.Ifaces = append(m.Ifaces, iface)
+					break
 				}
 			}
-		case <-finish:
-			return nil
 		}
 	}
+	return memberships, nil
 }
 
-// sendQuery is used to multicast a query out
-func (c *client) sendQuery(q *dns.Msg) error {
-	buf, err := q.Pack()
-	if err != nil {
-		return err
+// NewClient creates a new mdns Client that can be used to query
+// for records
+func NewClient() (*Client, error) {
+	return newClient(&QueryParam{})
+}
+
+// NewClientWithConns creates a new mdns Client using the provided listeners
+// rather than binding its own, for example when the sockets are passed in by
+// the service manager. Either listener may be nil, but not both. The
+// listeners are used to both send queries and receive responses, so would
+// normally be bound to the mDNS port and joined to the multicast group,
+// though queries with a UnicastAddr can use any listener, such as one on
+// loopback for testing against a Responder. The client takes ownership of
+// the listeners, closing them on Close.
+func NewClientWithConns(v4, v6 *net.UDPConn) (*Client, error) {
+	if v4 == nil && v6 == nil {
+		return nil, fmt.Errorf("%w: must provide at least one of an IPv4 and IPv6 listener", ErrInvalidParam)
 	}
-	if c.ipv4UnicastConn != nil {
-		_, err = c.ipv4UnicastConn.WriteToUDP(buf, ipv4Addr)
-		if err != nil {
-			return err
-		}
+	return newClientWithPacketConns(asPacketConn(v4), asPacketConn(v6)), nil
+}
+
+// newClientWithPacketConns creates a client using the provided listeners,
+// which need not be sockets, such as to test against an in-memory transport
+func newClientWithPacketConns(v4, v6 packetConn) *Client {
+	c := &Client{
+		ipv4MulticastConn: v4,
+		ipv6MulticastConn: v6,
+		ipv4Group:         ipv4Addr,
+		ipv6Group:         ipv6Addr,
+		logger:            log.Default(),
+		bufPool:           newBufPool(defaultRecvBufferSize),
+		rand:              newRand(),
+		closedCh:          make(chan struct{}),
 	}
-	if c.ipv6UnicastConn != nil {
-		_, err = c.ipv6UnicastConn.WriteToUDP(buf, ipv6Addr)
-		if err != nil {
-			return err
-		}
+	for _, l := range c.conns() {
+		enableControlMessages(l)
 	}
-	return nil
+	return c
+}
+
+// packetConn is the part of a listener the client sends and receives
+// packets with. It is satisfied by *net.UDPConn, and may be replaced by an
+// in-memory transport in tests. Socket options, such as the multicast
+// interface and reporting the receiving interface, only apply to a
+// *net.UDPConn.
+type packetConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	Close() error
 }
 
-// recv is used to receive until we get a shutdown
-func (c *client) recv(l *net.UDPConn, msgCh chan *dns.Msg) {
+// asPacketConn returns a listener as a packetConn, keeping a nil listener
+// nil rather than a non-nil interface holding it
+func asPacketConn(l *net.UDPConn) packetConn {
 	if l == nil {
-		return
+		return nil
 	}
-	buf := make([]byte, 65536)
-	for atomic.LoadInt32(&c.closed) == 0 {
-		n, err := l.Read(buf)
+	return l
+}
 
-		if atomic.LoadInt32(&c.closed) == 1 {
-			return
+// newClient creates a new mdns Client bound to the unicast and
+// multicast listeners of the families enabled by the parameters. The
+// multicast listeners are skipped when querying a unicast address.
+func newClient(params *QueryParam) (*Client, error) {
+	v4, v6 := !params.DisableIPv4, !params.DisableIPv6
+	if !v4 && !v6 {
+		return nil, fmt.Errorf("%w: must enable at least one of IPv4 and IPv6", ErrInvalidParam)
+	}
+	if _, err := resolveInterface(params); err != nil {
+		return nil, err
+	}
+	logger := params.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	bufSize := params.RecvBufferSize
+	if bufSize <= 0 {
+		bufSize = defaultRecvBufferSize
+	}
+	if params.SourcePort < 0 || params.SourcePort > 65535 {
+		return nil, fmt.Errorf("%w: invalid source port %d", ErrInvalidParam, params.SourcePort)
+	}
+
+	// Bind the unicast listener of the local address's family to it, so
+	// queries are sent from that address
+	laddr4, laddr6 := net.IPv4zero, net.IPv6zero
+	if ip := params.LocalAddr; ip != nil {
+		if err := checkLocalAddr(ip); err != nil {
+			return nil, err
+		}
+		if ip.To4() != nil {
+			if !v4 {
+				return nil, fmt.Errorf("%w: local address %v is IPv4, but IPv4 is disabled", ErrInvalidParam, ip)
+			}
+			laddr4 = ip
+		} else {
+			if !v6 {
+				return nil, fmt.Errorf("%w: local address %v is IPv6, but IPv6 is disabled", ErrInvalidParam, ip)
+			}
+			laddr6 = ip
 		}
+	}
 
+	// Create the unicast listeners, which queries are sent from
+	var uconn4, uconn6 *net.UDPConn
+	var bindErrs BindErrors
+	var err error
+	if v4 {
+		uconn4, err = listenUnicast("udp4", laddr4, params.SourcePort, params.ListenConfig)
 		if err != nil {
-			log.Printf("[ERR] mdns: Failed to read packet: %v", err)
-			continue
+			logger.Printf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+			bindErrs = append(bindErrs, &BindError{Network: "udp4", Err: err})
 		}
-		msg := new(dns.Msg)
-		if err := msg.Unpack(buf[:n]); err != nil {
-			log.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
-			continue
-		}
-		select {
-		case msgCh <- msg:
-		case <-c.closedCh:
-			return
+	}
+	if v6 {
+		uconn6, err = listenUnicast("udp6", laddr6, params.SourcePort, params.ListenConfig)
+		if err != nil {
+			logger.Printf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
+			bindErrs = append(bindErrs, &BindError{Network: "udp6", Err: err})
 		}
 	}
-}
 
-// ensureName is used to ensure the named node is in progress
-func ensureName(inprogress map[string]*ServiceEntry, name string) *ServiceEntry {
-	if inp, ok := inprogress[name]; ok {
-		return inp
+	if uconn4 == nil && uconn6 == nil {
+		return nil, bindErrs
+	}
+
+	// Create the multicast listeners
+	group4, group6 := params.IPv4Group, params.IPv6Group
+	if group4 == nil {
+		group4 = ipv4Addr
+	}
+	if group6 == nil {
+		group6 = ipv6Addr
+	}
+	var mconn4, mconn6 *net.UDPConn
+	if v4 && params.UnicastAddr == nil {
+		mconn4, err = listenMulticast("udp4", nil, group4, params.ListenConfig)
+		if err != nil {
+			logger.Printf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+			bindErrs = append(bindErrs, &BindError{Network: "udp4", Multicast: true, Err: err})
+		}
+	}
+	if v6 && params.UnicastAddr == nil {
+		mconn6, err = listenMulticast("udp6", nil, group6, params.ListenConfig)
+		if err != nil {
+			logger.Printf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
+			bindErrs = append(bindErrs, &BindError{Network: "udp6", Multicast: true, Err: err})
+		}
+	}
+
+	if mconn4 == nil && mconn6 == nil && params.UnicastAddr == nil {
+		if uconn4 != nil {
+			uconn4.Close()
+		}
+		if uconn6 != nil {
+			uconn6.Close()
+		}
+		return nil, bindErrs
+	}
+
+	c := &Client{
+		ipv4MulticastConn: asPacketConn(mconn4),
+		ipv6MulticastConn: asPacketConn(mconn6),
+		ipv4UnicastConn:   asPacketConn(uconn4),
+		ipv6UnicastConn:   asPacketConn(uconn6),
+		logger:            logger,
+		ipv4Group:         group4,
+		ipv6Group:         group6,
+		bufPool:           newBufPool(bufSize),
+		bindErrs:          bindErrs,
+		rand:              newRand(),
+		closedCh:          make(chan struct{}),
+	}
+	for _, l := range c.conns() {
+		enableControlMessages(l)
+	}
+	return c, nil
+}
+
+// checkLocalAddr returns an error if ip is not assigned to any of the
+// host's interfaces
+func checkLocalAddr(ip net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: local address %v is not assigned to any interface", ErrInvalidParam, ip)
+}
+
+// listenUnicast binds the listener queries are sent from to the address,
+// on an ephemeral port if port is zero. A fixed port is shared with other
+// sockets where the platform supports it, as the mDNS port usually has the
+// multicast listeners of this and other processes bound to it, in which
+// case the platform may deliver unicast responses to any of them. The
+// listener is bound with the config, if any.
+func listenUnicast(network string, ip net.IP, port int, config *net.ListenConfig) (*net.UDPConn, error) {
+	laddr := &net.UDPAddr{IP: ip, Port: port}
+	if port == 0 && config == nil {
+		return net.ListenUDP(network, laddr)
+	}
+	lc := listenConfig(config, port != 0)
+	pc, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// listenMulticast binds a listener to the multicast group, allowing the
+// port to be shared with the system responder and other clients where the
+// platform supports it. If that fails, it falls back to the behavior of
+// net.ListenMulticastUDP, unless the listener must be bound with a config,
+// which the fallback would ignore.
+func listenMulticast(network string, iface *net.Interface, gaddr *net.UDPAddr, config *net.ListenConfig) (*net.UDPConn, error) {
+	lc := listenConfig(config, true)
+	pc, err := lc.ListenPacket(context.Background(), network, gaddr.String())
+	if err == nil {
+		conn := pc.(*net.UDPConn)
+		if err = joinGroup(conn, network, iface, gaddr); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+	}
+	if config != nil {
+		return nil, err
+	}
+	return net.ListenMulticastUDP(network, iface, gaddr)
+}
+
+// listenConfig returns a copy of the config to bind a listener with, which
+// first shares the port if share is set, then runs the config's own Control
+func listenConfig(config *net.ListenConfig, share bool) net.ListenConfig {
+	var lc net.ListenConfig
+	if config != nil {
+		lc = *config
+	}
+	if !share {
+		return lc
+	}
+	control := lc.Control
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		if err := reusePortControl(network, address, c); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	return lc
+}
+
+// joinGroup joins the multicast group on the interface, or the system
+// default if iface is nil. Like net.ListenMulticastUDP, multicast loopback
+// is disabled on the listener.
+func joinGroup(conn *net.UDPConn, network string, iface *net.Interface, gaddr *net.UDPAddr) error {
+	if network == "udp4" {
+		p := ipv4.NewPacketConn(conn)
+		if iface != nil {
+			if err := p.SetMulticastInterface(iface); err != nil {
+				return err
+			}
+		}
+		if err := p.SetMulticastLoopback(false); err != nil {
+			return err
+		}
+		return p.JoinGroup(iface, gaddr)
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if iface != nil {
+		if err := p.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+	}
+	if err := p.SetMulticastLoopback(false); err != nil {
+		return err
+	}
+	return p.JoinGroup(iface, gaddr)
+}
+
+// loggerFor returns the logger for the diagnostics of a query, which is the
+// client's unless the query's parameters provide one
+func (c *Client) loggerFor(params *QueryParam) *log.Logger {
+	if params != nil && params.Logger != nil {
+		return params.Logger
+	}
+	return c.logger
+}
+
+// Close is used to cleanup the client
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		// something else already closed it
+		return nil
+	}
+
+	c.logger.Printf("[INFO] mdns: Closing client")
+	close(c.closedCh)
+
+	if c.ipv4UnicastConn != nil {
+		c.ipv4UnicastConn.Close()
+	}
+	if c.ipv6UnicastConn != nil {
+		c.ipv6UnicastConn.Close()
+	}
+	if c.ipv4MulticastConn != nil {
+		c.ipv4MulticastConn.Close()
+	}
+	if c.ipv6MulticastConn != nil {
+		c.ipv6MulticastConn.Close()
+	}
+
+	return nil
+}
+
+// Query looks up a given service, in a domain, waiting at most
+// for a timeout before finishing the query. The results are streamed
+// to a channel. Sends will not block, so clients should make sure to
+// either read or buffer. The client remains open after the query.
+func (c *Client) Query(params *QueryParam) error {
+	return c.QueryContext(context.Background(), params)
+}
+
+// QueryContext is the same as Query, however the query is stopped early
+// and ctx.Err() returned if the context is cancelled. A context deadline
+// sooner than the timeout ends the query at that deadline.
+func (c *Client) QueryContext(ctx context.Context, params *QueryParam) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClientClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if params.Entries == nil {
+		return ErrNoEntriesChannel
+	}
+
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return err
+	}
+
+	// Run the query
+	return c.query(ctx, params)
+}
+
+// prepare is used to apply the parameters of a query to the client, and
+// to ensure the defaults are set
+func (c *Client) prepare(params *QueryParam) error {
+	switch params.QueryType {
+	case 0, dns.TypePTR, dns.TypeTXT:
+	default:
+		return fmt.Errorf("%w: unsupported query type %s", ErrInvalidParam, dns.Type(params.QueryType))
+	}
+	for _, qtype := range params.QueryTypes {
+		if qtype == dns.TypeNone {
+			return fmt.Errorf("%w: query types must not be zero", ErrInvalidParam)
+		}
+	}
+
+	// Set the multicast interface
+	iface, err := resolveInterface(params)
+	if err != nil {
+		return err
+	}
+	if iface != nil || c.ifaceSet {
+		if err := c.setInterface(iface); err != nil {
+			return err
+		}
+		c.ifaceSet = iface != nil
+	}
+	if params.MulticastLoopback != nil {
+		c.saveMulticastLoopback()
+		if err := c.setMulticastLoopback(*params.MulticastLoopback); err != nil {
+			return err
+		}
+	} else if err := c.restoreMulticastLoopback(); err != nil {
+		return err
+	}
+	hops := params.MulticastHops
+	if hops == 0 {
+		hops = defaultMulticastHops
+	}
+	if hops < 1 || hops > 255 {
+		return fmt.Errorf("%w: multicast hops must be between 1 and 255: %d", ErrInvalidParam, hops)
+	}
+	if err := c.setMulticastHops(hops); err != nil {
+		// Platforms that can't set the default keep their own
+		if params.MulticastHops != 0 {
+			return err
+		}
+		c.loggerFor(params).Printf("[WARN] mdns: Failed to set the multicast TTL: %v", err)
+	}
+
+	// Ensure defaults are set
+	if params.Logger == nil {
+		params.Logger = c.logger
+	}
+	if params.Domain == "" {
+		params.Domain = "local"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = time.Second
+	}
+	return nil
+}
+
+// CancelQuery stops the query in progress on the client, if any, which
+// returns context.Canceled. Unlike Close, the client can be used for later
+// queries.
+func (c *Client) CancelQuery() {
+	c.cancelLock.Lock()
+	defer c.cancelLock.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// startQuery derives the context of a query that CancelQuery can cancel.
+// It must be called while holding queryLock, and the returned function
+// called once the query finishes.
+func (c *Client) startQuery(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancelLock.Lock()
+	c.cancel = cancel
+	c.cancelLock.Unlock()
+
+	return ctx, func() {
+		c.cancelLock.Lock()
+		c.cancel = nil
+		c.cancelLock.Unlock()
+		cancel()
+	}
+}
+
+// listServiceTypes issues the service type enumeration meta-query described
+// in section 9 of RFC 6763, returning the distinct service types found
+// with the domain removed
+func (c *Client) listServiceTypes(ctx context.Context, params *QueryParam) ([]string, error) {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return nil, err
+	}
+	domain := params.Domain
+	metaAddr := joinName("_services._dns-sd._udp", domain)
+
+	deadline, finish := queryWindow(ctx, params.Timeout)
+	msgCh, _, stop := c.startRecv(deadline, newSourceFilter(params), params)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion(metaAddr, dns.TypePTR)
+	m.RecursionDesired = false
+	if err := c.sendQuery(m, params); err != nil {
+		return nil, err
+	}
+
+	var types []string
+	seen := make(map[string]struct{})
+	for {
+		select {
+		case pkt := <-msgCh:
+			if !pkt.msg.Response {
+				continue
+			}
+			for _, answer := range responseRecords(pkt.msg) {
+				ptr, ok := answer.(*dns.PTR)
+				if !ok || !strings.EqualFold(ptr.Hdr.Name, metaAddr) {
+					continue
+				}
+				service := trimDomain(ptr.Ptr, domain)
+				if _, ok := seen[service]; ok {
+					continue
+				}
+				seen[service] = struct{}{}
+				types = append(types, service)
+			}
+		case <-finish:
+			return types, nil
+		case <-ctx.Done():
+			return types, ctx.Err()
+		}
+	}
+}
+
+// resolveHost queries for the A and AAAA records of a host name, returning
+// the distinct addresses found
+func (c *Client) resolveHost(ctx context.Context, name string, params *QueryParam) ([]net.IP, error) {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return nil, err
+	}
+	host := dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(host); !ok {
+		return nil, fmt.Errorf("%w: invalid host name %q", ErrInvalidParam, name)
+	}
+
+	deadline, finish := queryWindow(ctx, params.Timeout)
+	msgCh, _, stop := c.startRecv(deadline, newSourceFilter(params), params)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{
+		{Name: host, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: host, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	}
+	m.RecursionDesired = false
+	if err := c.sendQuery(m, params); err != nil {
+		return nil, err
+	}
+
+	var addrs []net.IP
+	seen := make(map[string]struct{})
+	for {
+		select {
+		case pkt := <-msgCh:
+			if !pkt.msg.Response {
+				continue
+			}
+			for _, answer := range responseRecords(pkt.msg) {
+				if !strings.EqualFold(answer.Header().Name, host) {
+					continue
+				}
+				var ip net.IP
+				switch rr := answer.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if _, ok := seen[ip.String()]; ok {
+					continue
+				}
+				seen[ip.String()] = struct{}{}
+				addrs = append(addrs, ip)
+			}
+		case <-finish:
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("%w: no addresses for %s", ErrNotFound, host)
+			}
+			return addrs, nil
+		case <-ctx.Done():
+			return addrs, ctx.Err()
+		}
+	}
+}
+
+// reverseLookup queries for the pointer from the reverse mapping name of an
+// address, returning the first host name found
+func (c *Client) reverseLookup(ctx context.Context, ip net.IP, params *QueryParam) (string, error) {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return "", err
+	}
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid address %v: %v", ErrInvalidParam, ip, err)
+	}
+
+	deadline, finish := queryWindow(ctx, params.Timeout)
+	msgCh, _, stop := c.startRecv(deadline, newSourceFilter(params), params)
+	defer stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypePTR)
+	m.RecursionDesired = false
+	if err := c.sendQuery(m, params); err != nil {
+		return "", err
+	}
+
+	for {
+		select {
+		case pkt := <-msgCh:
+			if !pkt.msg.Response {
+				continue
+			}
+			for _, answer := range responseRecords(pkt.msg) {
+				if ptr, ok := answer.(*dns.PTR); ok && strings.EqualFold(ptr.Hdr.Name, name) {
+					return ptr.Ptr, nil
+				}
+			}
+		case <-finish:
+			return "", fmt.Errorf("%w: no host name for %v", ErrNotFound, ip)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// resolveInterface returns the multicast interface selected by the
+// parameters, or nil to use the system default. The Interface parameter
+// takes precedence over InterfaceName, which takes precedence over
+// InterfaceIndex.
+func resolveInterface(params *QueryParam) (*net.Interface, error) {
+	var iface *net.Interface
+	var err error
+	switch {
+	case params.Interface != nil:
+		iface = params.Interface
+	case params.InterfaceName != "":
+		iface, err = net.InterfaceByName(params.InterfaceName)
+		if err != nil {
+			return nil, fmt.Errorf("%w: interface %q: %v", ErrNotFound, params.InterfaceName, err)
+		}
+	case params.InterfaceIndex != 0:
+		iface, err = net.InterfaceByIndex(params.InterfaceIndex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: interface with index %d: %v", ErrNotFound, params.InterfaceIndex, err)
+		}
+	default:
+		return nil, nil
+	}
+
+	// Some platforms accept a multicast interface that can never send, so
+	// catch these up front rather than silently finding nothing
+	if iface.Flags&net.FlagMulticast == 0 {
+		return nil, fmt.Errorf("%w: interface %s does not support multicast", ErrInvalidParam, iface.Name)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("%w: interface %s is down", ErrInvalidParam, iface.Name)
+	}
+	return iface, nil
+}
+
+// setInterface is used to set the query interface, uses system
+// default if not provided
+func (c *Client) setInterface(iface *net.Interface) error {
+	return c.setSocketOption(
+		func(p *ipv4.PacketConn) error { return p.SetMulticastInterface(iface) },
+		func(p *ipv6.PacketConn) error { return p.SetMulticastInterface(iface) },
+	)
+}
+
+// setMulticastLoopback sets whether the multicast packets sent by the
+// listeners are looped back to the host, so its own responders can answer
+func (c *Client) setMulticastLoopback(on bool) error {
+	return c.setSocketOption(
+		func(p *ipv4.PacketConn) error { return p.SetMulticastLoopback(on) },
+		func(p *ipv6.PacketConn) error { return p.SetMulticastLoopback(on) },
+	)
+}
+
+// savedLoopback is the multicast loopback of a listener before a query set it
+type savedLoopback struct {
+	conn *net.UDPConn
+	v6   bool
+	on   bool
+}
+
+// saveMulticastLoopback records the multicast loopback of each listener,
+// unless it was already recorded, before a query sets it
+func (c *Client) saveMulticastLoopback() {
+	if c.loopback != nil {
+		return
+	}
+	c.loopback = []savedLoopback{}
+	for _, l := range []packetConn{c.ipv4UnicastConn, c.ipv4MulticastConn} {
+		if l, ok := l.(*net.UDPConn); ok {
+			if on, err := ipv4.NewPacketConn(l).MulticastLoopback(); err == nil {
+				c.loopback = append(c.loopback, savedLoopback{conn: l, on: on})
+			}
+		}
+	}
+	for _, l := range []packetConn{c.ipv6UnicastConn, c.ipv6MulticastConn} {
+		if l, ok := l.(*net.UDPConn); ok {
+			if on, err := ipv6.NewPacketConn(l).MulticastLoopback(); err == nil {
+				c.loopback = append(c.loopback, savedLoopback{conn: l, v6: true, on: on})
+			}
+		}
+	}
+}
+
+// restoreMulticastLoopback sets each listener's multicast loopback back to
+// what it was before a query first set it, if one did
+func (c *Client) restoreMulticastLoopback() error {
+	for _, saved := range c.loopback {
+		var err error
+		if saved.v6 {
+			err = ipv6.NewPacketConn(saved.conn).SetMulticastLoopback(saved.on)
+		} else {
+			err = ipv4.NewPacketConn(saved.conn).SetMulticastLoopback(saved.on)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.loopback = nil
+	return nil
+}
+
+// setMulticastHops sets the IPv4 TTL and IPv6 hop limit of the multicast
+// packets sent by the listeners
+func (c *Client) setMulticastHops(hops int) error {
+	return c.setSocketOption(
+		func(p *ipv4.PacketConn) error { return p.SetMulticastTTL(hops) },
+		func(p *ipv6.PacketConn) error { return p.SetMulticastHopLimit(hops) },
+	)
+}
+
+// setSocketOption applies an option to each of the listeners of the family,
+// skipping those that aren't sockets
+func (c *Client) setSocketOption(set4 func(*ipv4.PacketConn) error, set6 func(*ipv6.PacketConn) error) error {
+	for _, l := range []packetConn{c.ipv4UnicastConn, c.ipv4MulticastConn} {
+		if l, ok := l.(*net.UDPConn); ok {
+			if err := set4(ipv4.NewPacketConn(l)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, l := range []packetConn{c.ipv6UnicastConn, c.ipv6MulticastConn} {
+		if l, ok := l.(*net.UDPConn); ok {
+			if err := set6(ipv6.NewPacketConn(l)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// query is used to perform a lookup and stream results
+func (c *Client) query(ctx context.Context, params *QueryParam) error {
+	// Create the service names
+	services, err := queryServices(params)
+	if err != nil {
+		return err
+	}
+
+	// Start listening for response packets, until the query window elapses.
+	// Responses answering the query extend a draining window, up to its
+	// limit, so listen until then.
+	deadline, finish := queryWindow(ctx, params.Timeout)
+	recvDeadline := deadline
+	var extend func()
+	if params.DrainAfterLastResponse > 0 && finish != nil {
+		limit := params.MaxTimeout
+		if limit == 0 {
+			limit = 3 * params.Timeout
+		}
+		recvDeadline, _ = queryWindow(ctx, limit)
+		end := deadline
+		timer := time.NewTimer(params.Timeout)
+		defer timer.Stop()
+		finish = timer.C
+		extend = func() {
+			next := drainDeadline(end, recvDeadline, time.Now().Add(params.DrainAfterLastResponse))
+			if !next.After(end) {
+				return
+			}
+			end = next
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(end))
+		}
+	}
+	msgCh, _, stop := c.startRecv(recvDeadline, newSourceFilter(params), params)
+	defer stop()
+
+	// Send the query, asking the instance directly when resolving one
+	m := newServiceQuery(services, params)
+	var instance string
+	if params.ResolveInstance != "" {
+		if instance, err = instanceAddr(params.ResolveInstance, params.Service, params.Domain); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidServiceName, err)
+		}
+		m = newInstanceQuery(instance, params)
+	}
+
+	// Schedule retransmissions of the query, doubling the interval between
+	// each as recommended by section 5.2 of RFC 6762, with some jitter
+	sends, retries := 1, params.Retries
+	if retries > maxQueryRetries {
+		retries = maxQueryRetries
+	}
+	var retryCh <-chan time.Time
+	var interval time.Duration
+	scheduleRetries := func() {
+		if retries > 1 {
+			interval = retryInterval(time.Until(deadline), retries)
+			retryCh = time.After(jitter(c.rand, interval))
+		}
+	}
+
+	// A cooperative query waits briefly before it is sent, and is not sent
+	// at all if another host asks the same question meanwhile, as the
+	// responses to theirs will answer ours. See section 7.3 of RFC 6762.
+	// Any other query waits for its initial delay.
+	var startCh <-chan time.Time
+	suppressed := false
+	delay := initialDelay(c.rand, params.InitialDelay, time.Until(deadline))
+	if params.Cooperative {
+		delay = cooperativeDelay(c.rand)
+	}
+	if delay > 0 {
+		startCh = time.After(delay)
+	} else {
+		if err := c.sendQuery(m, params); err != nil {
+			return err
+		}
+		scheduleRetries()
+	}
+
+	// Correlate the responses into entries, counting those found
+	assemblers := make(map[int]*assembler)
+	found := 0
+
+	// handle applies a received packet, returning whether the query has
+	// found what it was looking for
+	handle := func(pkt *packet) bool {
+		if params.Cooperative && startCh != nil && asksQuestions(pkt.msg, m) {
+			suppressed = true
+			return false
+		}
+		sendRawMessage(params, pkt.msg)
+		a := assemblerFor(assemblers, pkt, services, params)
+		updated := a.handleResponse(pkt)
+		if extend != nil && a.answersQuery(updated) {
+			extend()
+		}
+		if params.NoFilter {
+			for _, inp := range updated {
+				emitUnfiltered(params, inp)
+			}
+			return false
+		}
+		for _, inp := range updated {
+			if instance != "" && !strings.EqualFold(inp.Name, instance) {
+				continue
+			}
+			if !c.emitEntry(params, inp, params.AllowDuplicates) {
+				continue
+			}
+
+			// A resolved instance is all we were looking for
+			if instance != "" {
+				return true
+			}
+
+			// Stop early once we have enough distinct entries
+			if found++; params.MaxEntries > 0 && found >= params.MaxEntries {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Listen until we reach the timeout
+	for {
+		select {
+		case <-startCh:
+			startCh = nil
+			if !suppressed {
+				if err := c.sendQuery(m, params); err != nil {
+					return err
+				}
+			}
+			scheduleRetries()
+		case <-retryCh:
+			if err := c.sendQuery(m, params); err != nil {
+				params.Logger.Printf("[ERR] mdns: Failed to retransmit query: %v", err)
+			}
+			if sends++; sends < retries {
+				interval *= 2
+				retryCh = time.After(jitter(c.rand, interval))
+			} else {
+				retryCh = nil
+			}
+		case pkt := <-msgCh:
+			if handle(pkt) {
+				return nil
+			}
+		case <-finish:
+			// Responses received just before the window closed may not
+			// have been handled yet
+			drainPackets(msgCh, handle)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// validQueryName returns the name queried for the parameters' service, or
+// an error wrapping ErrInvalidServiceName if it is not a valid domain name
+func validQueryName(params *QueryParam) (string, error) {
+	name := queryName(params)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidServiceName, name)
+	}
+	return name, nil
+}
+
+// queriedService is a service looked up by a query
+type queriedService struct {
+	name     string // Service type, such as "_http._tcp"
+	addr     string // Name queried for pointers to instances, including any subtype
+	instance string // Name the instances of the service are under
+
+	// descendants is whether pointers owned by names under addr also
+	// match, as when enumerating every instance of a service rather than
+	// narrowing to a subtype
+	descendants bool
+}
+
+// queryServices returns the service and any additional services looked up
+// by the parameters, or an error wrapping ErrInvalidServiceName if any of
+// their names are not valid domain names
+func queryServices(params *QueryParam) ([]queriedService, error) {
+	names := params.Services
+	if params.Service != "" || len(names) == 0 {
+		names = append([]string{params.Service}, names...)
+	}
+	services := make([]queriedService, 0, len(names))
+	for _, name := range names {
+		p := *params
+		p.Service = name
+		addr, err := validQueryName(&p)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, queriedService{
+			name:        trimDot(name),
+			addr:        addr,
+			instance:    joinName(name, params.Domain),
+			descendants: params.Subtype == "",
+		})
+	}
+	return services, nil
+}
+
+// queryWindow returns when a query should stop listening, which is after
+// the timeout, or at the context's deadline if that is sooner. The returned
+// channel fires at the end of the window, unless the context's deadline
+// ends it, in which case it is nil and ctx.Done() fires instead.
+func queryWindow(ctx context.Context, timeout time.Duration) (time.Time, <-chan time.Time) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d, nil
+	}
+	return deadline, time.After(timeout)
+}
+
+// drainDeadline returns when a query extended to listen until next should
+// stop, which is never before its current end, nor after its limit
+func drainDeadline(end, limit, next time.Time) time.Time {
+	if next.After(limit) {
+		next = limit
+	}
+	if next.Before(end) {
+		return end
+	}
+	return next
+}
+
+// cooperativeDelay returns how long a cooperative query waits for the same
+// question from another host before sending its own, which is random to
+// avoid hosts waiting in lockstep
+func cooperativeDelay(r *rand.Rand) time.Duration {
+	return cooperativeMinDelay + time.Duration(r.Int63n(int64(cooperativeMaxDelay-cooperativeMinDelay)))
+}
+
+// initialDelay returns a random delay before a query is first sent, between
+// a sixth of the maximum and the maximum so the default follows section 5.2
+// of RFC 6762. The delay is kept within the first half of the query window,
+// leaving time to collect the responses.
+func initialDelay(r *rand.Rand, max, window time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	if max > window/2 {
+		max = window / 2
+	}
+	if max <= 0 {
+		return 0
+	}
+	return max/6 + time.Duration(r.Int63n(int64(max-max/6)+1))
+}
+
+// asksQuestions returns whether msg is a query asking each of the questions
+// of q with multicast responses, so its answers will be seen by the client
+func asksQuestions(msg, q *dns.Msg) bool {
+	if msg.Response {
+		return false
+	}
+	for _, want := range q.Question {
+		found := false
+		for _, got := range msg.Question {
+			if strings.EqualFold(got.Name, want.Name) && got.Qtype == want.Qtype && got.Qclass == want.Qclass&^(1<<15) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// queryName returns the name queried for the parameters' service, which
+// is the subtype's name when one is set, per section 7.1 of RFC 6763
+func queryName(params *QueryParam) string {
+	if params.Subtype != "" {
+		return joinName(params.Subtype, "_sub", params.Service, params.Domain)
+	}
+	return joinName(params.Service, params.Domain)
+}
+
+// newServiceQuery builds the query for the pointers to instances of the
+// services, asking a question for each
+func newServiceQuery(services []queriedService, params *QueryParam) *dns.Msg {
+	m := new(dns.Msg)
+	types := params.QueryTypes
+	if len(types) == 0 {
+		types = []uint16{dns.TypePTR}
+	}
+	for _, service := range services {
+		for _, qtype := range types {
+			m.Question = append(m.Question, dns.Question{
+				Name:   service.addr,
+				Qtype:  qtype,
+				Qclass: questionClass(params),
+			})
+		}
+	}
+	m.RecursionDesired = false
+	return m
+}
+
+// newInstanceQuery builds the query for the records describing a single
+// instance of a service
+func newInstanceQuery(instanceAddr string, params *QueryParam) *dns.Msg {
+	m := new(dns.Msg)
+	m.Question = []dns.Question{
+		{Name: instanceAddr, Qtype: dns.TypeSRV, Qclass: questionClass(params)},
+		{Name: instanceAddr, Qtype: dns.TypeTXT, Qclass: questionClass(params)},
+	}
+	if params.QueryType == dns.TypeTXT {
+		m.Question = m.Question[1:]
+	}
+	if len(params.QueryTypes) > 0 {
+		m.Question = m.Question[:0]
+		for _, qtype := range params.QueryTypes {
+			m.Question = append(m.Question, dns.Question{Name: instanceAddr, Qtype: qtype, Qclass: questionClass(params)})
+		}
+	}
+	m.RecursionDesired = false
+	return m
+}
+
+// questionClass returns the qclass of the questions asked by a query
+func questionClass(params *QueryParam) uint16 {
+	class := params.QueryClass
+	if class == 0 {
+		class = dns.ClassINET
+	}
+	// RFC 6762, section 18.12.  Repurposing of Top Bit of qclass in Question
+	// Section
+	//
+	// In the Question Section of a Multicast DNS query, the top bit of the qclass
+	// field is used to indicate that unicast responses are preferred for this
+	// particular question.  (See Section 5.4.)
+	if params.WantUnicastResponse {
+		class |= 1 << 15
+	}
+	return class
+}
+
+// sendRawMessage streams a copy of a response to the caller, if they asked
+// for them. Sends do not block.
+func sendRawMessage(params *QueryParam, msg *dns.Msg) {
+	if params.RawMessages == nil || !msg.Response {
+		return
+	}
+	select {
+	case params.RawMessages <- msg.Copy():
+	default:
+	}
+}
+
+// emitEntry streams a copy of the entry if it is complete, and otherwise
+// queries the instance directly for the missing records. An entry that was
+// already streamed is only streamed again if resend is set. Returns whether
+// the entry was complete for the first time.
+func (c *Client) emitEntry(params *QueryParam, inp *ServiceEntry, resend bool) bool {
+	if inp.completeFor(params.QueryType) {
+		if inp.sent && !resend {
+			return false
+		}
+		first := !inp.sent
+		inp.sent = true
+		entry := *inp
+		entry.Partial = false
+		select {
+		case params.Entries <- &entry:
+		default:
+			params.Stats.countDropped()
+		}
+		return first
+	}
+
+	// Let the caller show the entry as it fills in, if they asked to
+	if params.EmitPartial {
+		entry := *inp
+		entry.Partial = true
+		select {
+		case params.Entries <- &entry:
+		default:
+			params.Stats.countDropped()
+		}
+	}
+
+	// Fire off a node specific query, for just the missing TXT records of
+	// a TXT query
+	qtype := dns.TypePTR
+	if params.QueryType == dns.TypeTXT {
+		qtype = dns.TypeTXT
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(inp.Name, qtype)
+	m.Question[0].Qclass = questionClass(params)
+	m.RecursionDesired = false
+
+	// Ask for the addresses too once the host is known, in case the
+	// responder doesn't include them with its service record
+	if qtype == dns.TypePTR && inp.Host != "" && inp.AddrV4 == nil && inp.AddrV6 == nil && inp.Addr == nil {
+		m.Question = append(m.Question,
+			dns.Question{Name: dns.Fqdn(inp.Host), Qtype: dns.TypeA, Qclass: questionClass(params)},
+			dns.Question{Name: dns.Fqdn(inp.Host), Qtype: dns.TypeAAAA, Qclass: questionClass(params)},
+		)
+	}
+	if err := c.sendQuery(m, params); err != nil {
+		params.Logger.Printf("[ERR] mdns: Failed to query instance %s: %v", inp.Name, err)
+	}
+	return false
+}
+
+// drainPackets applies the packets already received on the channel, without
+// waiting for more, until handle reports that it is done
+func drainPackets(msgCh <-chan *packet, handle func(*packet) bool) {
+	for {
+		select {
+		case pkt := <-msgCh:
+			if handle(pkt) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// assemblerFor returns the assembler of a query for a packet, creating it on
+// first use. If PerInterface is set each receiving interface has its own,
+// with the packets received on an unknown interface sharing one, and
+// otherwise every packet shares the same one.
+func assemblerFor(assemblers map[int]*assembler, pkt *packet, services []queriedService, params *QueryParam) *assembler {
+	index := 0
+	if params.PerInterface && pkt.iface != nil {
+		index = pkt.iface.Index
+	}
+	a, ok := assemblers[index]
+	if !ok {
+		a = newAssembler(services, params)
+		assemblers[index] = a
+	}
+	return a
+}
+
+// emitUnfiltered streams a copy of an entry whether or not it is complete,
+// marking it Partial if not, for queries that use every record
+func emitUnfiltered(params *QueryParam, inp *ServiceEntry) {
+	entry := *inp
+	entry.Partial = !inp.completeFor(params.QueryType)
+	select {
+	case params.Entries <- &entry:
+	default:
+		params.Stats.countDropped()
+	}
+}
+
+// assembler correlates the records in the responses to a query into the
+// service entries they describe
+type assembler struct {
+	services []queriedService
+	params   *QueryParam
+
+	// inprogress maps names to the entries being assembled, and seen
+	// holds the keys of the records already processed by record set
+	inprogress map[string]*ServiceEntry
+	seen       map[rrset]map[string]struct{}
+
+	// flushed holds the record sets replaced by the current response
+	flushed map[rrset]struct{}
+
+	// key is reused to build the key of each record
+	key []byte
+}
+
+// rrset identifies the records of a type for a name
+type rrset struct {
+	name   string
+	rrtype uint16
+}
+
+// newAssembler creates an assembler for responses about the services
+func newAssembler(services []queriedService, params *QueryParam) *assembler {
+	return &assembler{
+		services:   services,
+		params:     params,
+		inprogress: make(map[string]*ServiceEntry),
+		seen:       make(map[rrset]map[string]struct{}),
+		flushed:    make(map[rrset]struct{}),
+	}
+}
+
+// handleResponse applies the records of a response to the in progress
+// entries, returning the entries updated by new records in the order they
+// were first updated. A single response may describe several instances.
+func (a *assembler) handleResponse(pkt *packet) []*ServiceEntry {
+	// Queries from other hosts may carry records they know of, but only
+	// responses are trusted to describe instances
+	if !pkt.msg.Response {
+		return nil
+	}
+
+	var updated []*ServiceEntry
+	touch := func(inp *ServiceEntry) {
+		// Record where and for what the entry was discovered
+		inp.Iface = pkt.iface
+		if pkt.src != nil {
+			inp.SrcAddr = pkt.src.IP
+		}
+		if pkt.dst != nil {
+			inp.Unicast = !pkt.dst.IsMulticast()
+		}
+		a.setServiceType(inp)
+		for _, e := range updated {
+			if e == inp {
+				return
+			}
+		}
+		updated = append(updated, inp)
+	}
+
+	for set := range a.flushed {
+		delete(a.flushed, set)
+	}
+
+	// Walk the sections in place, rather than with responseRecords, as
+	// this runs for every packet received
+	for _, section := range [...][]dns.RR{pkt.msg.Answer, pkt.msg.Ns, pkt.msg.Extra} {
+		for _, answer := range section {
+			a.handleRecord(pkt, answer, touch)
+		}
+	}
+	return updated
+}
+
+// handleRecord applies a single record of a response to the in progress
+// entries, passing those it updates to touch
+func (a *assembler) handleRecord(pkt *packet, answer dns.RR, touch func(*ServiceEntry)) {
+	if !a.matches(answer) {
+		return
+	}
+
+	// A record with a zero TTL is a goodbye, announcing that the
+	// record is going away, as per section 10.1 of RFC 6762. A
+	// goodbye for the pointer to an instance removes the instance.
+	if answer.Header().Ttl == 0 {
+		if ptr, ok := answer.(*dns.PTR); ok {
+			a.remove(ptr)
+		}
+		return
+	}
+
+	// Skip records we've already processed, as responders often
+	// repeat them across packets. Looking the key up by conversion
+	// only allocates once it is stored.
+	if !a.params.AllowDuplicates {
+		hdr := answer.Header()
+		set := rrset{name: strings.ToLower(hdr.Name), rrtype: hdr.Rrtype}
+
+		// A record with the cache-flush bit set replaces the records of
+		// its set from earlier responses, per section 10.2 of RFC 6762,
+		// so they are no longer known when they are asserted again
+		if _, ok := a.flushed[set]; !ok && hdr.Class&(1<<15) != 0 {
+			a.flushed[set] = struct{}{}
+			delete(a.seen, set)
+		}
+
+		a.key = recordKey(a.key, answer)
+		keys, ok := a.seen[set]
+		if !ok {
+			keys = make(map[string]struct{})
+			a.seen[set] = keys
+		}
+		if _, ok := keys[string(a.key)]; ok {
+			return
+		}
+		keys[string(a.key)] = struct{}{}
+	}
+	if stats := a.params.Stats; stats != nil {
+		atomic.AddUint64(&stats.RecordsMatched, 1)
+	}
+
+	switch rr := answer.(type) {
+	case *dns.PTR:
+		// Create new entry for this
+		touch(ensureName(a.inprogress, rr.Ptr))
+
+	case *dns.SRV:
+		// Check for a target mismatch. A strict target isn't aliased to
+		// the instance, so the records of the instance's own name aren't
+		// taken for the host's, and a new target's addresses replace those
+		// of the old one.
+		inp := ensureName(a.inprogress, rr.Hdr.Name)
+		if a.params.StrictSRVTarget {
+			if !strings.EqualFold(inp.Host, rr.Target) {
+				inp.Addr, inp.AddrV4, inp.AddrV6, inp.AddrV6Zone = nil, nil, nil, ""
+			}
+		} else if nameKey(rr.Target) != nameKey(rr.Hdr.Name) {
+			alias(a.inprogress, rr.Hdr.Name, rr.Target)
+		}
+
+		// Get the port
+		inp.Host = rr.Target
+		inp.Port = int(rr.Port)
+		inp.Priority = int(rr.Priority)
+		inp.Weight = int(rr.Weight)
+
+		// The host's addresses may have arrived already, for another
+		// instance on the same host
+		a.copyHostAddrs(inp)
+		touch(inp)
+
+	case *dns.TXT:
+		// Pull out the txt
+		inp := ensureName(a.inprogress, rr.Hdr.Name)
+		inp.Info = strings.Join(rr.Txt, "|")
+		inp.InfoFields = rr.Txt
+		inp.hasTXT = true
+		touch(inp)
+
+	case *dns.A:
+		// Pull out the IP, for every instance on the host
+		for _, inp := range a.hostEntries(rr.Hdr.Name) {
+			if inp.Addr == nil {
+				inp.Addr = rr.A // @Deprecated
+			}
+			inp.AddrV4 = rr.A
+			touch(inp)
+		}
+
+	case *dns.NSEC:
+		// A responder lists the types of record that exist for a name,
+		// as per section 6.1 of RFC 6762, so an instance without a TXT
+		// record needn't be waited on for one. Only instances already
+		// in progress are marked, as the name may be a host, including
+		// the host an instance is aliased to.
+		inp, ok := a.inprogress[nameKey(rr.Hdr.Name)]
+		if !ok || inp.hasTXT || !strings.EqualFold(inp.Name, rr.Hdr.Name) {
+			return
+		}
+		inp.noTXT = true
+		for _, t := range rr.TypeBitMap {
+			if t == dns.TypeTXT {
+				inp.noTXT = false
+			}
+		}
+		touch(inp)
+
+	case *dns.AAAA:
+		// Pull out the IP, for every instance on the host
+		for _, inp := range a.hostEntries(rr.Hdr.Name) {
+			if inp.Addr == nil {
+				inp.Addr = rr.AAAA // @Deprecated
+			}
+			inp.AddrV6 = rr.AAAA
+			inp.AddrV6Zone = ""
+			if rr.AAAA.IsLinkLocalUnicast() && pkt.iface != nil {
+				inp.AddrV6Zone = pkt.iface.Name
+			}
+			touch(inp)
+		}
+	}
+}
+
+// matches reports whether a record should be applied. Unless the caller
+// provided a matcher, pointers that don't correspond to our service are
+// ignored, which may arrive when sharing the multicast group with other
+// queriers. Pointers owned by a subdomain of a service type queried, such as
+// one of its subtypes, are for its instances too, so match unless a subtype
+// is queried. If QueryTypes is set, only records of the types asked for, or
+// of those entries are built from, are applied. Every record is applied if
+// NoFilter is set.
+func (a *assembler) matches(rr dns.RR) bool {
+	if a.params.NoFilter {
+		return true
+	}
+	if types := a.params.QueryTypes; len(types) > 0 && !hasType(types, rr.Header().Rrtype) {
+		return false
+	}
+	if a.params.Match != nil {
+		return a.params.Match(rr)
+	}
+	ptr, ok := rr.(*dns.PTR)
+	if !ok {
+		return true
+	}
+	for _, service := range a.services {
+		if strings.EqualFold(ptr.Hdr.Name, service.addr) {
+			return true
+		}
+		if service.descendants && dns.IsSubDomain(service.addr, ptr.Hdr.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasType reports whether a record type is among those asked for, which
+// includes every type if dns.TypeANY was asked for. The types entries are
+// built from are always included, so that entries can be completed, such as
+// by the answers to the follow-up queries for the records they are missing.
+func hasType(types []uint16, rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypePTR, dns.TypeSRV, dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeNSEC:
+		return true
+	}
+	for _, t := range types {
+		if t == rrtype || t == dns.TypeANY {
+			return true
+		}
+	}
+	return false
+}
+
+// hostEntries returns the entry for a name, along with any other entries
+// whose host it is. Several instances may share a host, and so the host's
+// address records. With StrictSRVTarget, the entry for the name is left out
+// if it is an instance on another host.
+func (a *assembler) hostEntries(host string) []*ServiceEntry {
+	var entries []*ServiceEntry
+	if e := ensureName(a.inprogress, host); !a.params.StrictSRVTarget || e.Host == "" || strings.EqualFold(e.Host, host) {
+		entries = append(entries, e)
+	}
+	for _, inp := range a.inprogress {
+		if !strings.EqualFold(inp.Host, host) {
+			continue
+		}
+		found := false
+		for _, e := range entries {
+			if e == inp {
+				found = true
+				break
+			}
+		}
+		if !found {
+			entries = append(entries, inp)
+		}
+	}
+	return entries
+}
+
+// copyHostAddrs fills in the addresses an entry is missing from another
+// entry on the same host
+func (a *assembler) copyHostAddrs(inp *ServiceEntry) {
+	for _, e := range a.hostEntries(inp.Host) {
+		if e == inp {
+			continue
+		}
+		if inp.AddrV4 == nil && e.AddrV4 != nil {
+			inp.AddrV4 = e.AddrV4
+		}
+		if inp.AddrV6 == nil && e.AddrV6 != nil {
+			inp.AddrV6, inp.AddrV6Zone = e.AddrV6, e.AddrV6Zone
+		}
+		if inp.Addr == nil {
+			inp.Addr = e.Addr // @Deprecated
+		}
+	}
+}
+
+// setServiceType records the service type and domain queried on an entry,
+// so entries from several queries can be told apart. The service type is
+// the one the entry's name is under, or the first queried if none match.
+func (a *assembler) setServiceType(inp *ServiceEntry) {
+	inp.Domain = trimDot(a.params.Domain)
+	if len(a.services) == 0 {
+		return
+	}
+	inp.ServiceType = a.services[0].name
+	if service, ok := a.serviceOf(inp.Name); ok {
+		inp.ServiceType = service.name
+	}
+}
+
+// serviceOf returns the service queried that an instance's name is under
+func (a *assembler) serviceOf(name string) (queriedService, bool) {
+	for _, service := range a.services {
+		suffix := service.instance
+		if n := len(name) - len(suffix); n > 0 && name[n-1] == '.' && strings.EqualFold(name[n:], suffix) {
+			return service, true
+		}
+	}
+	return queriedService{}, false
+}
+
+// answersQuery reports whether any of the entries updated by a response
+// are instances of the services queried, rather than other hosts' records
+// seen on the multicast group
+func (a *assembler) answersQuery(updated []*ServiceEntry) bool {
+	for _, inp := range updated {
+		if _, ok := a.serviceOf(inp.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the instance a goodbye pointer is for, notifying the caller
+// of its removal
+func (a *assembler) remove(ptr *dns.PTR) {
+	removed := removeName(a.inprogress, ptr.Ptr)
+	a.setServiceType(removed)
+	if a.params.Removed != nil {
+		select {
+		case a.params.Removed <- removed:
+		default:
+			a.params.Stats.countDropped()
+		}
+	}
+	a.forget(ptr, removed)
+}
+
+// forget drops the records seen for a removed instance, so that it is
+// assembled afresh if it returns. Only the instance's own records are
+// forgotten, and its host's unless another instance is on the host, so
+// that the unchanged announcements of other instances aren't taken as
+// updates.
+func (a *assembler) forget(ptr *dns.PTR, removed *ServiceEntry) {
+	// The pointer set is shared by every instance of the service, so only
+	// the removed instance's pointer is dropped from it. The key ignores
+	// the TTL, so the goodbye's key is that of the announcement.
+	a.key = recordKey(a.key, ptr)
+	delete(a.seen[rrset{name: nameKey(ptr.Hdr.Name), rrtype: dns.TypePTR}], string(a.key))
+
+	names := map[string]struct{}{nameKey(ptr.Ptr): {}}
+	if host := nameKey(removed.Host); host != "" && !a.onHost(host) {
+		names[host] = struct{}{}
+	}
+	for set := range a.seen {
+		if _, ok := names[set.name]; ok {
+			delete(a.seen, set)
+		}
+	}
+}
+
+// onHost reports whether any instance in progress is on the host
+func (a *assembler) onHost(host string) bool {
+	for _, inp := range a.inprogress {
+		if strings.EqualFold(inp.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// startRecv starts receiving packets from each listener until the deadline
+// passes, dropping those from sources not accepted by the filter if one is
+// given. The Stats and OnPacket parameters of the query are applied to the
+// packets if params is given. The returned function stops the receivers and
+// waits for them to exit, so they don't steal packets from a subsequent
+// query on the same client. If every receiver fails, an error wrapping
+// ErrListenersFailed is sent on the returned error channel.
+func (c *Client) startRecv(deadline time.Time, accept sourceFilter, params *QueryParam) (<-chan *packet, <-chan error, func()) {
+	c.sentLock.Lock()
+	c.sent = nil
+	c.sentLock.Unlock()
+
+	msgCh := make(chan *packet, 32)
+	errCh := make(chan error, 1)
+	doneCh := make(chan struct{})
+	conns := c.conns()
+	failed := int32(0)
+	var wg sync.WaitGroup
+	for _, l := range conns {
+		if err := l.SetReadDeadline(deadline); err != nil {
+			c.loggerFor(params).Printf("[ERR] mdns: Failed to set read deadline: %v", err)
+		}
+		wg.Add(1)
+		go func(l packetConn) {
+			defer wg.Done()
+			err := c.recv(l, msgCh, doneCh, accept, params)
+			if err != nil && atomic.AddInt32(&failed, 1) == int32(len(conns)) {
+				errCh <- fmt.Errorf("%w: %v", ErrListenersFailed, err)
+			}
+		}(l)
+	}
+
+	stop := func() {
+		close(doneCh)
+		for _, l := range c.conns() {
+			l.SetReadDeadline(time.Now())
+		}
+		wg.Wait()
+	}
+	return msgCh, errCh, stop
+}
+
+// sourceFilter reports whether packets from a source should be accepted
+type sourceFilter func(src *net.UDPAddr) bool
+
+// newSourceFilter returns a filter accepting only packets from the local
+// link, as section 11 of RFC 6762 requires of responses, or nil if the
+// parameters allow remote responses. A responder the query was sent to
+// directly is always accepted.
+func newSourceFilter(params *QueryParam) sourceFilter {
+	if params.AllowRemoteResponses {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		params.Logger.Printf("[WARN] mdns: Failed to list interface addresses, accepting all sources: %v", err)
+		return nil
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			networks = append(networks, ipnet)
+		}
+	}
+	return func(src *net.UDPAddr) bool {
+		if params.UnicastAddr != nil && params.UnicastAddr.IP.Equal(src.IP) {
+			return true
+		}
+		return isLocalSource(src.IP, networks)
+	}
+}
+
+// isLocalSource returns whether ip is link local, or on one of the directly
+// connected networks
+func isLocalSource(ip net.IP, networks []*net.IPNet) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newBufPool returns a pool of buffers of the given size to read packets
+// into
+func newBufPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// conns returns each of the listeners that were bound
+func (c *Client) conns() []packetConn {
+	var conns []packetConn
+	for _, l := range []packetConn{
+		c.ipv4UnicastConn,
+		c.ipv6UnicastConn,
+		c.ipv4MulticastConn,
+		c.ipv6MulticastConn,
+	} {
+		if l != nil {
+			conns = append(conns, l)
+		}
+	}
+	return conns
+}
+
+// retryInterval returns the delay before the first retransmission of a query
+// that is sent the given number of times. The delay doubles after each
+// retransmission, with the final one sent half way through the timeout so
+// there is still time to collect its responses.
+func retryInterval(timeout time.Duration, sends int) time.Duration {
+	return timeout / 2 / time.Duration(1<<uint(sends-1)-1)
+}
+
+// jitter randomly varies an interval by up to 20% either way, so that
+// clients started at the same time don't retransmit in lockstep, per
+// section 5.2 of RFC 6762
+func jitter(r *rand.Rand, d time.Duration) time.Duration {
+	return d*8/10 + time.Duration(r.Int63n(int64(d)*4/10+1))
+}
+
+// newRand returns a random source for a client's jitter
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// sendConn4 returns the listener used to send IPv4 queries, preferring the
+// unicast listener so responses come back to an ephemeral port
+func (c *Client) sendConn4() packetConn {
+	if c.ipv4UnicastConn != nil {
+		return c.ipv4UnicastConn
+	}
+	return c.ipv4MulticastConn
+}
+
+// sendConn6 returns the listener used to send IPv6 queries, preferring the
+// unicast listener so responses come back to an ephemeral port
+func (c *Client) sendConn6() packetConn {
+	if c.ipv6UnicastConn != nil {
+		return c.ipv6UnicastConn
+	}
+	return c.ipv6MulticastConn
+}
+
+// sendQuery is used to multicast a query out, or to send it directly to
+// the unicast address of the parameters if set
+//
+// The query succeeds as long as at least one of the listeners accepted the
+// packet. If every write fails, an error describing each failure is returned.
+func (c *Client) sendQuery(q *dns.Msg, params *QueryParam) error {
+	// Advertise a larger payload size, so responders can fit more records
+	// in each response rather than truncating it
+	if params.UDPSize > dns.MinMsgSize && q.IsEdns0() == nil {
+		q.SetEdns0(params.UDPSize, false)
+	}
+	buf, err := q.Pack()
+	if err != nil {
+		return err
+	}
+	c.rememberSent(buf)
+
+	// Only send over the families the caller enabled, as the client may
+	// have listeners for both
+	conn4, conn6 := c.sendConn4(), c.sendConn6()
+	if params.DisableIPv4 {
+		conn4 = nil
+	}
+	if params.DisableIPv6 {
+		conn6 = nil
+	}
+
+	if dst := params.UnicastAddr; dst != nil {
+		conn := conn6
+		if dst.IP.To4() != nil {
+			conn = conn4
+		}
+		if conn == nil {
+			return fmt.Errorf("%w: no enabled listener available to send query to %v", ErrInvalidParam, dst)
+		}
+		if _, err := conn.WriteTo(buf, dst); err != nil {
+			return err
+		}
+		params.Stats.countSent(dst.IP.To4() != nil, len(buf))
+		return nil
+	}
+
+	// A failure of one family, such as when its interface just went down,
+	// doesn't fail the query as long as the other family sent it
+	var errs SendErrors
+	sent := false
+	if conn := conn4; conn != nil {
+		if _, err := conn.WriteTo(buf, c.ipv4Group); err != nil {
+			errs = append(errs, &SendError{Network: "udp4", Err: err})
+			params.Stats.countSendFailure()
+		} else {
+			sent = true
+			params.Stats.countSent(true, len(buf))
+		}
+	}
+	if conn := conn6; conn != nil {
+		if _, err := conn.WriteTo(buf, c.ipv6Group); err != nil {
+			errs = append(errs, &SendError{Network: "udp6", Err: err})
+			params.Stats.countSendFailure()
+		} else {
+			sent = true
+			params.Stats.countSent(false, len(buf))
+		}
+	}
+	if !sent {
+		if len(errs) == 0 {
+			return fmt.Errorf("%w: no enabled listeners available to send query", ErrInvalidParam)
+		}
+		return errs
+	}
+	for _, err := range errs {
+		c.loggerFor(params).Printf("[WARN] mdns: Query only partially sent: %v", err)
+	}
+	return nil
+}
+
+// SendError describes a family a query could not be sent over
+type SendError struct {
+	Network string // "udp4" or "udp6"
+	Err     error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("failed to send query over %s: %v", e.Network, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// SendErrors lists the families a query could not be sent over. It is
+// returned when sending failed over every family enabled. If the query was
+// sent over any of them, the failures are only logged and counted in the
+// Stats parameter.
+type SendErrors []*SendError
+
+func (e SendErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the failure of each family, which errors.Is and errors.As
+// check on Go 1.20 and later
+func (e SendErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Is matches the target against the failure of each family, for versions
+// of Go before 1.20 whose errors.Is doesn't use Unwrap() []error
+func (e SendErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failure of a family matching the target, for versions
+// of Go before 1.20 whose errors.As doesn't use Unwrap() []error
+func (e SendErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberSent records a query sent by the client, so that copies of it
+// looped back to the listeners can be ignored
+func (c *Client) rememberSent(buf []byte) {
+	c.sentLock.Lock()
+	defer c.sentLock.Unlock()
+	if c.sent == nil {
+		c.sent = make(map[string]struct{})
+	}
+	c.sent[string(buf)] = struct{}{}
+}
+
+// isEcho returns whether the packet is a copy of a query the client sent
+// since it started receiving
+func (c *Client) isEcho(buf []byte) bool {
+	c.sentLock.Lock()
+	defer c.sentLock.Unlock()
+	_, ok := c.sent[string(buf)]
+	return ok
+}
+
+// packet is a response received by one of the listeners
+type packet struct {
+	msg   *dns.Msg
+	src   *net.UDPAddr   // Address of the sender
+	dst   net.IP         // Destination address, if known
+	iface *net.Interface // Receiving interface, if known
+}
+
+// packetReader reads a datagram into the buffer, returning its size, the
+// index of the interface it arrived on (or 0 if unknown), its destination
+// address (or nil if unknown) and the sender
+type packetReader func(buf []byte) (int, int, net.IP, net.Addr, error)
+
+// isIPv4Conn returns whether the listener is bound to an IPv4 address
+func isIPv4Conn(l packetConn) bool {
+	addr, ok := l.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() != nil
+}
+
+// enableControlMessages asks the platform to report the receiving interface
+// and destination address of each packet on the listener. This must be done before any packets
+// arrive, so is done when binding. Platforms that don't support it simply
+// won't report the interface, nor will listeners that aren't sockets.
+func enableControlMessages(l packetConn) {
+	udp, ok := l.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	if isIPv4Conn(udp) {
+		ipv4.NewPacketConn(udp).SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
+	} else {
+		ipv6.NewPacketConn(udp).SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true)
+	}
+}
+
+// newPacketReader returns a reader for the listener which reports the
+// receiving interface and destination address, where the platform supports
+// it. The control messages are enabled again on the reader, as it must size
+// its buffers for them. Listeners that aren't sockets report neither.
+func newPacketReader(l packetConn) packetReader {
+	udp, ok := l.(*net.UDPConn)
+	if !ok {
+		return func(buf []byte) (int, int, net.IP, net.Addr, error) {
+			n, src, err := l.ReadFrom(buf)
+			return n, 0, nil, src, err
+		}
+	}
+
+	if isIPv4Conn(udp) {
+		p := ipv4.NewPacketConn(udp)
+		p.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
+		return func(buf []byte) (int, int, net.IP, net.Addr, error) {
+			n, cm, src, err := p.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, nil, src, err
+			}
+			return n, cm.IfIndex, cm.Dst, src, err
+		}
+	}
+
+	p := ipv6.NewPacketConn(udp)
+	p.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true)
+	return func(buf []byte) (int, int, net.IP, net.Addr, error) {
+		n, cm, src, err := p.ReadFrom(buf)
+		if cm == nil {
+			return n, 0, nil, src, err
+		}
+		return n, cm.IfIndex, cm.Dst, src, err
+	}
+}
+
+// recv is used to receive until we get a shutdown, the query is done, or
+// the read deadline of the listener passes.
+//
+// Temporary read errors are retried with a backoff, while any other error
+// (such as the listener being closed) stops the receive loop and is returned.
+func (c *Client) recv(l packetConn, msgCh chan *packet, doneCh <-chan struct{}, accept sourceFilter, params *QueryParam) error {
+	if l == nil {
+		return nil
+	}
+	var stats *Stats
+	var onPacket OnPacketFunc
+	rate := defaultMaxPacketRate
+	if params != nil {
+		stats, onPacket = params.Stats, params.OnPacket
+		if params.MaxPacketRate != 0 {
+			rate = params.MaxPacketRate
+		}
+	}
+	limit := newRateLimiter(rate)
+	var warned time.Time
+	logger := c.loggerFor(params)
+
+	read := newPacketReader(l)
+	ifaces := make(map[int]*net.Interface)
+	bufp := c.bufPool.Get().(*[]byte)
+	defer c.bufPool.Put(bufp)
+	buf := *bufp
+	var backoff time.Duration
+	for atomic.LoadInt32(&c.closed) == 0 {
+		n, ifIndex, dst, from, err := read(buf)
+
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return nil
+		}
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// The query window has elapsed
+				return nil
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				logger.Printf("[ERR] mdns: Failed to read packet: %v", err)
+				return err
+			}
+
+			// Back off so a persistent error does not spin the loop
+			if backoff == 0 {
+				backoff = recvMinBackoff
+			} else if backoff *= 2; backoff > recvMaxBackoff {
+				backoff = recvMaxBackoff
+			}
+			logger.Printf("[WARN] mdns: Temporary failure reading packet, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-doneCh:
+				return nil
+			case <-c.closedCh:
+				return nil
+			}
+			continue
+		}
+		backoff = 0
+		if stats != nil {
+			atomic.AddUint64(&stats.PacketsReceived, 1)
+		}
+
+		// Drop a flood of packets before spending any time on them,
+		// warning at most once a second
+		if now := time.Now(); !limit.allow(now) {
+			if stats != nil {
+				atomic.AddUint64(&stats.PacketsDropped, 1)
+			}
+			if now.Sub(warned) >= time.Second {
+				warned = now
+				logger.Printf("[WARN] mdns: Receiving over %d packets per second, dropping the excess", rate)
+			}
+			continue
+		}
+
+		src, _ := from.(*net.UDPAddr)
+		if accept != nil && src != nil && !accept(src) {
+			continue
+		}
+
+		// Ignore our own queries, looped back by the system
+		if c.isEcho(buf[:n]) {
+			continue
+		}
+
+		msg, err := unpackPacket(buf[:n])
+		if onPacket != nil {
+			onPacket(from, buf[:n], err)
+		}
+		if err != nil {
+			logger.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
+			if stats != nil {
+				atomic.AddUint64(&stats.ParseFailures, 1)
+			}
+			continue
+		}
+		pkt := &packet{msg: msg, src: src, dst: dst}
+
+		// Look up the receiving interface, caching it as most packets
+		// arrive on the same few interfaces
+		if ifIndex != 0 {
+			iface, ok := ifaces[ifIndex]
+			if !ok {
+				iface, _ = net.InterfaceByIndex(ifIndex)
+				ifaces[ifIndex] = iface
+			}
+			pkt.iface = iface
+		}
+
+		select {
+		case msgCh <- pkt:
+		case <-doneCh:
+			return nil
+		case <-c.closedCh:
+			return nil
+		}
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket allowing a number of events per second, in
+// bursts of up to a second's worth
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate events per second, or nil
+// to allow every event if the rate is negative
+func newRateLimiter(rate int) *rateLimiter {
+	if rate < 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// allow reports whether an event at the given time is within the rate
+func (r *rateLimiter) allow(now time.Time) bool {
+	if r == nil {
+		return true
+	}
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.rate {
+			r.tokens = r.rate
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// unpackPacket unpacks a received packet. A truncated response may end part
+// way through a record, so the records that did fit are kept. The rest are
+// expected to follow in subsequent packets.
+func unpackPacket(buf []byte) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	err := msg.Unpack(buf)
+	if err == nil || !msg.Truncated {
+		return msg, err
+	}
+	return unpackTruncated(buf)
+}
+
+// unpackTruncated unpacks as many whole records as fit in a truncated
+// packet. The record counts in the header are reduced, dropping records
+// from the end of the packet, until it can be unpacked.
+func unpackTruncated(buf []byte) (*dns.Msg, error) {
+	// The answer, authority and additional counts are the last three
+	// fields of the 12 byte header
+	const headerLen = 12
+	if len(buf) < headerLen {
+		return nil, fmt.Errorf("packet too short for header: %d bytes", len(buf))
+	}
+	b := make([]byte, len(buf))
+	copy(b, buf)
+	for {
+		msg := new(dns.Msg)
+		err := msg.Unpack(b)
+		if err == nil {
+			return msg, nil
+		}
+
+		// Drop the last record
+		dropped := false
+		for _, off := range []int{10, 8, 6} {
+			if n := binary.BigEndian.Uint16(b[off:]); n > 0 {
+				binary.BigEndian.PutUint16(b[off:], n-1)
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			return nil, err
+		}
+	}
+}
+
+// responseRecords returns the records from each section of a response.
+// Responders commonly put the records describing an instance in the
+// additional section, and some use the authority section, so all are
+// considered.
+func responseRecords(resp *dns.Msg) []dns.RR {
+	recs := make([]dns.RR, 0, len(resp.Answer)+len(resp.Ns)+len(resp.Extra))
+	recs = append(recs, resp.Answer...)
+	recs = append(recs, resp.Ns...)
+	return append(recs, resp.Extra...)
+}
+
+// recordKey returns a key identifying the name, type and data of a record,
+// ignoring the TTL and cache-flush bit which vary between announcements. The
+// key is the uncompressed wire format of the record, built in buf if it is
+// large enough.
+func recordKey(buf []byte, rr dns.RR) []byte {
+	hdr := rr.Header()
+	ttl, class := hdr.Ttl, hdr.Class
+	hdr.Ttl = 0
+	hdr.Class &^= 1 << 15
+
+	if n := dns.Len(rr); cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:cap(buf)]
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		// Fall back to the presentation format
+		buf = append(buf[:0], rr.String()...)
+	} else {
+		buf = buf[:off]
+	}
+
+	hdr.Ttl, hdr.Class = ttl, class
+	return buf
+}
+
+// ensureName is used to ensure the named node is in progress
+func ensureName(inprogress map[string]*ServiceEntry, name string) *ServiceEntry {
+	key := nameKey(name)
+	if inp, ok := inprogress[key]; ok {
+		return inp
 	}
 	inp := &ServiceEntry{
 		Name: name,
 	}
-	inprogress[name] = inp
+	inprogress[key] = inp
+	return inp
+}
+
+// removeName is used to remove the named node, and any aliases of it,
+// from the in progress entries. The removed entry is returned, or a new
+// entry with just the name if the node was not in progress.
+func removeName(inprogress map[string]*ServiceEntry, name string) *ServiceEntry {
+	inp, ok := inprogress[nameKey(name)]
+	if !ok {
+		return &ServiceEntry{Name: name}
+	}
+	for key, entry := range inprogress {
+		if entry == inp {
+			delete(inprogress, key)
+		}
+	}
 	return inp
 }
 
 // alias is used to setup an alias between two entries
 func alias(inprogress map[string]*ServiceEntry, src, dst string) {
 	srcEntry := ensureName(inprogress, src)
-	inprogress[dst] = srcEntry
+	inprogress[nameKey(dst)] = srcEntry
+}
+
+// nameKey returns the key of a name in the in progress entries. Names are
+// compared case-insensitively, as responders may capitalize them
+// differently from the query, or from one record to the next.
+func nameKey(name string) string {
+	return strings.ToLower(name)
 }
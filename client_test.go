@@ -0,0 +1,3113 @@
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// filterZone wraps a Zone and drops any records of the given type
+type filterZone struct {
+	Zone
+	drop uint16
+}
+
+func (f *filterZone) Records(q dns.Question) []dns.RR {
+	var out []dns.RR
+	for _, rr := range f.Zone.Records(q) {
+		if rr.Header().Rrtype != f.drop {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func TestClient_Query_Reassembles(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_reassemble._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_reassemble._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(entries)
+
+	var got []*ServiceEntry
+	for e := range entries {
+		got = append(got, e)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 entry, got %d: %v", len(got), got)
+	}
+	e := got[0]
+	if e.Name != "hostname._reassemble._tcp.local." {
+		t.Fatalf("bad name: %v", e)
+	}
+	if e.Host != "testhost." {
+		t.Fatalf("bad host: %v", e)
+	}
+	if e.Port != 80 {
+		t.Fatalf("bad port: %v", e)
+	}
+	if e.AddrV4 == nil || e.AddrV6 == nil {
+		t.Fatalf("bad addrs: %v", e)
+	}
+	// The A record is seen first, and must not be clobbered by the AAAA
+	if !e.Addr.Equal(e.AddrV4) {
+		t.Fatalf("Addr should be the first address seen: %v", e)
+	}
+	if e.Info != "Local web server" {
+		t.Fatalf("bad info: %v", e)
+	}
+	if e.SrcAddr == nil {
+		t.Fatalf("missing source address: %v", e)
+	}
+	if e.Iface == nil {
+		t.Fatalf("missing receiving interface: %v", e)
+	}
+}
+
+func TestClient_Query_DropsIncomplete(t *testing.T) {
+	zone := &filterZone{
+		Zone: makeServiceWithServiceName(t, "_incomplete._tcp"),
+		drop: dns.TypeTXT,
+	}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_incomplete._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-entries:
+		t.Fatalf("incomplete entry should not be emitted: %v", e)
+	default:
+	}
+}
+
+func TestClient_QueryContext_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	params := &QueryParam{
+		Service: "_cancel._tcp",
+		Domain:  "local",
+		Timeout: 10 * time.Second,
+		Entries: make(chan *ServiceEntry, 1),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- QueryContext(ctx, params)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("query did not stop on cancellation")
+	}
+}
+
+func TestClient_CancelQuery(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_cancelquery._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Without a query in progress there is nothing to cancel
+	c.CancelQuery()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Query(&QueryParam{
+			Service: "_cancelquery._tcp",
+			Domain:  "local",
+			Timeout: 10 * time.Second,
+			Entries: make(chan *ServiceEntry, 4),
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.CancelQuery()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("query did not stop on cancellation")
+	}
+
+	// The client can still be queried
+	entries := make(chan *ServiceEntry, 4)
+	err = c.Query(&QueryParam{
+		Service: "_cancelquery._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("record not found after cancelling")
+	}
+}
+
+func TestClient_QueryContext_Deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	params := &QueryParam{
+		Service: "_deadline._tcp",
+		Domain:  "local",
+		Timeout: 10 * time.Second,
+		Entries: make(chan *ServiceEntry, 1),
+	}
+
+	start := time.Now()
+	if err := QueryContext(ctx, params); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the context deadline should end the query, took %v", elapsed)
+	}
+}
+
+func TestQueryWindow(t *testing.T) {
+	// The timeout applies when it is sooner
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	deadline, finish := queryWindow(ctx, time.Second)
+	if finish == nil || time.Until(deadline) > time.Second {
+		t.Fatalf("expected the timeout to end the window, got %v", deadline)
+	}
+
+	// The context's deadline applies when it is sooner
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	deadline, finish = queryWindow(ctx, time.Hour)
+	if finish != nil || !deadline.Equal(want) {
+		t.Fatalf("expected the context deadline to end the window, got %v", deadline)
+	}
+}
+
+func TestClient_Query_InvalidServiceName(t *testing.T) {
+	for _, service := range []string{
+		strings.Repeat("a", 64) + "._tcp",
+		"_http.._tcp",
+	} {
+		err := Query(&QueryParam{
+			Service: service,
+			Domain:  "local",
+			Timeout: 10 * time.Millisecond,
+			Entries: make(chan *ServiceEntry, 1),
+		})
+		if !errors.Is(err, ErrInvalidServiceName) {
+			t.Fatalf("%q: expected ErrInvalidServiceName, got: %v", service, err)
+		}
+	}
+}
+
+func TestClient_Query_NoEntriesChannel(t *testing.T) {
+	params := &QueryParam{
+		Service: "_foobar._tcp",
+		Domain:  "local",
+		Timeout: 10 * time.Millisecond,
+	}
+	if err := Query(params); err != ErrNoEntriesChannel {
+		t.Fatalf("expected ErrNoEntriesChannel, got: %v", err)
+	}
+
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if err := c.Query(params); err != ErrNoEntriesChannel {
+		t.Fatalf("expected ErrNoEntriesChannel from the client, got: %v", err)
+	}
+}
+
+func TestClient_QueryContext_AlreadyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The interface doesn't exist, so binding would fail
+	stats := &Stats{}
+	params := &QueryParam{
+		Service:   "_foobar._tcp",
+		Domain:    "local",
+		Timeout:   time.Second,
+		Interface: &net.Interface{Index: 1 << 20, Name: "missing0"},
+		Entries:   make(chan *ServiceEntry, 1),
+		Stats:     stats,
+	}
+	if err := QueryContext(ctx, params); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if err := c.QueryContext(ctx, params); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from the client, got: %v", err)
+	}
+	if stats.QueriesSentV4 != 0 || stats.QueriesSentV6 != 0 {
+		t.Fatalf("expected no queries to be sent: %+v", stats)
+	}
+}
+
+func TestNewServiceQuery_Services(t *testing.T) {
+	params := &QueryParam{
+		Service:  "_http._tcp",
+		Services: []string{"_ipp._tcp"},
+		Domain:   "local",
+		Subtype:  "_printer",
+	}
+	services, err := queryServices(params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m := newServiceQuery(services, params)
+	var names []string
+	for _, q := range m.Question {
+		names = append(names, q.Name)
+	}
+	want := []string{"_printer._sub._http._tcp.local.", "_printer._sub._ipp._tcp.local."}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+
+	params.Services = []string{"_bad.._tcp"}
+	if _, err := queryServices(params); !errors.Is(err, ErrInvalidServiceName) {
+		t.Fatalf("expected ErrInvalidServiceName, got: %v", err)
+	}
+}
+
+func TestAsksQuestions(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("_coop._tcp.local.", dns.TypePTR)
+	q.Question[0].Qclass |= 1 << 15
+
+	other := new(dns.Msg)
+	other.SetQuestion("_COOP._tcp.local.", dns.TypePTR)
+	if !asksQuestions(other, q) {
+		t.Fatalf("expected the same question to match")
+	}
+
+	// Answers to a unicast question won't be seen by the client
+	other.Question[0].Qclass |= 1 << 15
+	if asksQuestions(other, q) {
+		t.Fatalf("expected a unicast question not to match")
+	}
+
+	other.SetQuestion("_coop._tcp.local.", dns.TypeSRV)
+	if asksQuestions(other, q) {
+		t.Fatalf("expected a different type not to match")
+	}
+
+	other.SetQuestion("_coop._tcp.local.", dns.TypePTR)
+	other.Response = true
+	if asksQuestions(other, q) {
+		t.Fatalf("expected a response not to match")
+	}
+}
+
+func TestClient_Query_Unicast(t *testing.T) {
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 15355}
+	respond := zoneResponder(makeServiceWithServiceName(t, "_qu._tcp"))
+
+	// The listener on the group doesn't loop back what it sends, so answers
+	// to the group are sent from another socket
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+
+	for _, unicast := range []bool{true, false} {
+		// Answer the query either directly or to the group
+		responder, err := listenMulticast("udp4", nil, group, nil)
+		if err != nil {
+			t.Skipf("IPv4 multicast is unavailable: %v", err)
+		}
+		go func(unicast bool) {
+			buf := make([]byte, 65536)
+			for {
+				n, from, err := responder.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				out := respond(buf[:n])
+				if out == nil {
+					continue
+				}
+				if unicast {
+					responder.WriteToUDP(out, from)
+				} else {
+					peer.WriteToUDP(out, group)
+				}
+			}
+		}(unicast)
+
+		entries := make(chan *ServiceEntry, 4)
+		err = Query(&QueryParam{
+			Service:     "_qu._tcp",
+			Domain:      "local",
+			Timeout:     50 * time.Millisecond,
+			Entries:     entries,
+			DisableIPv6: true,
+			IPv4Group:   group,
+		})
+		responder.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(entries) == 0 {
+			t.Fatalf("unicast %v: no entries found", unicast)
+		}
+		if e := <-entries; e.Unicast != unicast {
+			t.Fatalf("expected Unicast %v, got %v", unicast, e.Unicast)
+		}
+	}
+}
+
+func TestClient_Query_Cooperative(t *testing.T) {
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 15354}
+	questions := func(cooperative bool) int {
+		// Count the queries seen on the group
+		detector, err := listenMulticast("udp4", nil, group, nil)
+		if err != nil {
+			t.Skipf("IPv4 multicast is unavailable: %v", err)
+		}
+		defer detector.Close()
+		peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer peer.Close()
+
+		q := new(dns.Msg)
+		q.SetQuestion("_coop._tcp.local.", dns.TypePTR)
+		buf, err := q.Pack()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Another host asks the same question before the client
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			peer.WriteToUDP(buf, group)
+		}()
+		err = Query(&QueryParam{
+			Service:     "_coop._tcp",
+			Domain:      "local",
+			Timeout:     150 * time.Millisecond,
+			Entries:     make(chan *ServiceEntry, 1),
+			DisableIPv6: true,
+			IPv4Group:   group,
+			Cooperative: cooperative,
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		count := 0
+		rbuf := make([]byte, 65536)
+		detector.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		for {
+			n, _, err := detector.ReadFrom(rbuf)
+			if err != nil {
+				return count
+			}
+			var msg dns.Msg
+			if err := msg.Unpack(rbuf[:n]); err == nil && !msg.Response {
+				count++
+			}
+		}
+	}
+
+	if n := questions(false); n != 2 {
+		t.Fatalf("expected the client to send its own query, saw %d queries", n)
+	}
+	if n := questions(true); n != 1 {
+		t.Fatalf("expected the client to suppress its query, saw %d queries", n)
+	}
+}
+
+func TestClient_SendQuery_PartialFailure(t *testing.T) {
+	c, err := newClient(&QueryParam{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if c.ipv4UnicastConn == nil || c.ipv6UnicastConn == nil {
+		t.Skip("dual-stack unicast listeners required")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("_partial._tcp.local.", dns.TypePTR)
+
+	// A single failed family should not fail the query
+	c.ipv4UnicastConn.Close()
+	if err := c.sendQuery(m, &QueryParam{}); err != nil {
+		t.Fatalf("expected partial success, got: %v", err)
+	}
+
+	// Every family failing should be reported
+	c.ipv6UnicastConn.Close()
+	if err := c.sendQuery(m, &QueryParam{}); err == nil {
+		t.Fatalf("expected error when all writes fail")
+	}
+}
+
+func TestClient_SendQuery_DisabledFamily(t *testing.T) {
+	l4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		l4.Close()
+		t.Skip("IPv6 loopback required")
+	}
+	c, err := NewClientWithConns(l4, l6)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Send to a detector for each family, rather than the multicast groups
+	var detectors []*net.UDPConn
+	for _, addr := range []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}, {IP: net.IPv6loopback}} {
+		d, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer d.Close()
+		d.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		detectors = append(detectors, d)
+	}
+	c.ipv4Group = detectors[0].LocalAddr().(*net.UDPAddr)
+	c.ipv6Group = detectors[1].LocalAddr().(*net.UDPAddr)
+
+	m := new(dns.Msg)
+	m.SetQuestion("_family._tcp.local.", dns.TypePTR)
+	if err := c.sendQuery(m, &QueryParam{DisableIPv6: true}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	buf := make([]byte, 65536)
+	if _, _, err := detectors[0].ReadFrom(buf); err != nil {
+		t.Fatalf("expected an IPv4 query: %v", err)
+	}
+	if _, _, err := detectors[1].ReadFrom(buf); err == nil {
+		t.Fatalf("expected no IPv6 query")
+	}
+
+	// With every family disabled there is nothing to send on
+	if err := c.sendQuery(m, &QueryParam{DisableIPv4: true, DisableIPv6: true}); err == nil {
+		t.Fatalf("expected an error with every family disabled")
+	}
+}
+
+func TestClient_Query_UnicastResponse(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_unicast._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:             "_unicast._tcp",
+		Domain:              "local",
+		Timeout:             50 * time.Millisecond,
+		Entries:             entries,
+		WantUnicastResponse: true,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._unicast._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestClient_Recv_ClosedListener(t *testing.T) {
+	c, err := newClient(&QueryParam{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	l := c.ipv4UnicastConn
+	if l == nil {
+		l = c.ipv6UnicastConn
+	}
+	l.SetReadDeadline(time.Now().Add(10 * time.Second))
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.recv(l, make(chan *packet, 1), nil, nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("recv should return on a closed listener")
+	}
+}
+
+func TestClient_Recv_IgnoresEcho(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+	c, err := NewClientWithConns(conn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	msgCh, _, stop := c.startRecv(time.Now().Add(time.Second), nil, nil)
+	defer stop()
+
+	// A copy of a query we sent is dropped, while other packets are not
+	q := new(dns.Msg)
+	q.SetQuestion("_echo._tcp.local.", dns.TypePTR)
+	echo, _ := q.Pack()
+	c.rememberSent(echo)
+	q.SetQuestion("_other._tcp.local.", dns.TypePTR)
+	other, _ := q.Pack()
+	peer.WriteToUDP(echo, conn.LocalAddr().(*net.UDPAddr))
+	peer.WriteToUDP(other, conn.LocalAddr().(*net.UDPAddr))
+
+	select {
+	case pkt := <-msgCh:
+		if pkt.msg.Question[0].Name != "_other._tcp.local." {
+			t.Fatalf("expected the echo to be dropped, got: %v", pkt.msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet not received")
+	}
+}
+
+func TestAssembler_IgnoresQueries(t *testing.T) {
+	s := makeService(t)
+	q := new(dns.Msg)
+	q.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	q.Answer = s.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})
+
+	a := newAssembler([]queriedService{{addr: "_http._tcp.local."}}, &QueryParam{})
+	if updated := a.handleResponse(&packet{msg: q}); len(updated) != 0 {
+		t.Fatalf("expected the known answers of a query to be ignored: %v", updated)
+	}
+}
+
+func TestClient_Recv_Deadline(t *testing.T) {
+	c, err := newClient(&QueryParam{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	l := c.ipv4UnicastConn
+	if l == nil {
+		l = c.ipv6UnicastConn
+	}
+	l.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		c.recv(l, make(chan *packet, 1), nil, nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("recv should return once the deadline passes")
+	}
+}
+
+func TestClient_ReuseAcrossQueries(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_reuse._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Service: "_reuse._tcp",
+			Domain:  "local",
+			Timeout: 50 * time.Millisecond,
+			Entries: entries,
+		}
+		if err := c.Query(params); err != nil {
+			t.Fatalf("query %d: err: %v", i, err)
+		}
+		select {
+		case e := <-entries:
+			if e.Name != "hostname._reuse._tcp.local." {
+				t.Fatalf("query %d: bad: %v", i, e)
+			}
+		default:
+			t.Fatalf("query %d: record not found", i)
+		}
+	}
+
+	c.Close()
+	if err := c.Query(DefaultParams("_reuse._tcp")); err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed querying a closed client, got: %v", err)
+	}
+}
+
+func TestClient_Query_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	params := &QueryParam{
+		Service: "_logger._tcp",
+		Domain:  "local",
+		Timeout: 10 * time.Millisecond,
+		Entries: make(chan *ServiceEntry, 1),
+		Logger:  log.New(&buf, "", 0),
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(buf.String(), "mdns: Closing client") {
+		t.Fatalf("expected output on the provided logger, got: %q", buf.String())
+	}
+}
+
+func TestClient_Query_LoggerDiagnostics(t *testing.T) {
+	// The diagnostics of receiving go to the query's logger, rather than
+	// the client's default
+	conn := newMemConn(func([]byte) []byte { return []byte{0xde, 0xad} })
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	var buf bytes.Buffer
+	params := &QueryParam{
+		Service: "_logger._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: make(chan *ServiceEntry, 1),
+		Logger:  log.New(&buf, "", 0),
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(buf.String(), "[ERR] mdns: Failed to unpack packet") {
+		t.Fatalf("expected the unpack failure on the provided logger, got: %q", buf.String())
+	}
+}
+
+func TestClient_DisableFamily(t *testing.T) {
+	c, err := newClient(&QueryParam{DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if c.ipv6UnicastConn != nil || c.ipv6MulticastConn != nil {
+		t.Fatalf("IPv6 listeners should not be bound")
+	}
+	if c.ipv4UnicastConn == nil || c.ipv4MulticastConn == nil {
+		t.Fatalf("IPv4 listeners should be bound")
+	}
+
+	if _, err := newClient(&QueryParam{DisableIPv4: true, DisableIPv6: true}); err == nil {
+		t.Fatalf("expected error when disabling every family")
+	}
+}
+
+// lossyZone wraps a Zone and ignores any questions asked before a deadline
+type lossyZone struct {
+	Zone
+	until time.Time
+}
+
+func (l *lossyZone) Records(q dns.Question) []dns.RR {
+	if time.Now().Before(l.until) {
+		return nil
+	}
+	return l.Zone.Records(q)
+}
+
+func TestClient_Query_Retries(t *testing.T) {
+	zone := &lossyZone{
+		Zone:  makeServiceWithServiceName(t, "_retry._tcp"),
+		until: time.Now().Add(10 * time.Millisecond),
+	}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_retry._tcp",
+		Domain:  "local",
+		Timeout: 150 * time.Millisecond,
+		Entries: entries,
+		Retries: 3,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(entries)
+
+	var got []*ServiceEntry
+	for e := range entries {
+		got = append(got, e)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected exactly 1 entry after retransmission, got %d: %v", len(got), got)
+	}
+}
+
+func TestRetryInterval(t *testing.T) {
+	for _, test := range []struct {
+		sends int
+		want  time.Duration
+	}{
+		{2, 500 * time.Millisecond},
+		{3, time.Second / 6},
+	} {
+		if got := retryInterval(time.Second, test.sends); got != test.want {
+			t.Errorf("retryInterval(1s, %d) = %v, want %v", test.sends, got, test.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if d := jitter(r, time.Second); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+
+	// The same seed gives the same intervals
+	a, b := rand.New(rand.NewSource(2)), rand.New(rand.NewSource(2))
+	for i := 0; i < 10; i++ {
+		if x, y := jitter(a, time.Second), jitter(b, time.Second); x != y {
+			t.Fatalf("expected seeded jitter to be deterministic: %v != %v", x, y)
+		}
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if d := initialDelay(r, 120*time.Millisecond, time.Second); d < 20*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("delay out of range: %v", d)
+		}
+	}
+
+	// The delay is kept to the first half of the window
+	for i := 0; i < 1000; i++ {
+		if d := initialDelay(r, time.Second, 100*time.Millisecond); d > 50*time.Millisecond {
+			t.Fatalf("delay outside the window: %v", d)
+		}
+	}
+	if d := initialDelay(r, 0, time.Second); d != 0 {
+		t.Fatalf("expected no delay when zeroed, got %v", d)
+	}
+}
+
+func TestCooperativeDelay(t *testing.T) {
+	r1, r2 := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		d := cooperativeDelay(r1)
+		if d < cooperativeMinDelay || d >= cooperativeMaxDelay {
+			t.Fatalf("delay out of range: %v", d)
+		}
+		if d2 := cooperativeDelay(r2); d2 != d {
+			t.Fatalf("expected the same delays from the same seed, got %v and %v", d, d2)
+		}
+	}
+}
+
+func TestClient_Query_AllowDuplicates(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_dups._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	for _, test := range []struct {
+		allow bool
+		min   int
+		max   int
+	}{
+		{false, 1, 1},
+		{true, 2, 100},
+	} {
+		entries := make(chan *ServiceEntry, 100)
+		params := &QueryParam{
+			Service:         "_dups._tcp",
+			Domain:          "local",
+			Timeout:         100 * time.Millisecond,
+			Entries:         entries,
+			Retries:         2,
+			AllowDuplicates: test.allow,
+		}
+		if err := Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n := len(entries); n < test.min || n > test.max {
+			t.Fatalf("AllowDuplicates=%v: got %d entries, want between %d and %d", test.allow, n, test.min, test.max)
+		}
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.168.0.1"),
+	}
+	b := dns.Copy(a).(*dns.A)
+	b.Hdr.Ttl = 10
+	b.Hdr.Class |= 1 << 15
+	if ttl := b.Hdr.Ttl; string(recordKey(nil, a)) != string(recordKey(nil, b)) || b.Hdr.Ttl != ttl {
+		t.Fatalf("TTL and cache-flush bit should not affect the key: %q != %q", recordKey(nil, a), recordKey(nil, b))
+	}
+
+	b.A = net.ParseIP("192.168.0.2")
+	if string(recordKey(nil, a)) == string(recordKey(nil, b)) {
+		t.Fatalf("different data should produce different keys")
+	}
+}
+
+func TestListServiceTypes(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_listed._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	types, err := ListServiceTypes(50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(types) != 1 || types[0] != "_listed._tcp" {
+		t.Fatalf("bad service types: %v", types)
+	}
+}
+
+func TestServiceEntry_PreferredAddr(t *testing.T) {
+	v4 := net.ParseIP("192.168.0.42")
+	global := net.ParseIP("2620:0:1000:1900:b0c2:d0b2:c411:18bc")
+	ula := net.ParseIP("fd00::1")
+	linkLocal := net.ParseIP("fe80::1")
+	for _, test := range []struct {
+		v4, v6   net.IP
+		globalV6 bool
+		want     net.IP
+	}{
+		{v4, global, true, global},
+		{v4, global, false, v4},
+		{v4, ula, true, v4},
+		{v4, linkLocal, true, v4},
+		{nil, linkLocal, true, linkLocal},
+		{nil, global, false, global},
+		{v4, nil, true, v4},
+		{nil, nil, true, nil},
+	} {
+		e := &ServiceEntry{AddrV4: test.v4, AddrV6: test.v6}
+		if got := e.preferredAddr(test.globalV6); !got.Equal(test.want) {
+			t.Errorf("preferredAddr(%v) for %v and %v = %v, want %v", test.globalV6, test.v4, test.v6, got, test.want)
+		}
+	}
+}
+
+func TestServiceEntry_TXTMap(t *testing.T) {
+	e := &ServiceEntry{
+		InfoFields: []string{
+			"path=/api",
+			"Version=2",
+			"secure",
+			"empty=",
+			"version=3",
+			"=novalue",
+			"url=http://host/?a=b",
+		},
+	}
+	want := map[string]string{
+		"path":    "/api",
+		"version": "2",
+		"secure":  "",
+		"empty":   "",
+		"url":     "http://host/?a=b",
+	}
+	if got := e.TXTMap(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// goodbyeZone wraps a Zone and answers with zero TTLs, as a responder
+// does when it is going away
+type goodbyeZone struct {
+	Zone
+}
+
+func (g *goodbyeZone) Records(q dns.Question) []dns.RR {
+	recs := g.Zone.Records(q)
+	for i, rr := range recs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		recs[i] = rr
+	}
+	return recs
+}
+
+func TestClient_Query_Goodbye(t *testing.T) {
+	zone := &goodbyeZone{Zone: makeServiceWithServiceName(t, "_goodbye._tcp")}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	removed := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_goodbye._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+		Removed: removed,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-removed:
+		if e.Name != "hostname._goodbye._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("expected a removal notification")
+	}
+	select {
+	case e := <-entries:
+		t.Fatalf("departing instance should not be emitted: %v", e)
+	default:
+	}
+}
+
+func TestRemoveName(t *testing.T) {
+	inprogress := make(map[string]*ServiceEntry)
+	alias(inprogress, "instance._http._tcp.local.", "host.local.")
+	ensureName(inprogress, "other._http._tcp.local.")
+
+	e := removeName(inprogress, "instance._http._tcp.local.")
+	if e.Name != "instance._http._tcp.local." {
+		t.Fatalf("bad: %v", e)
+	}
+	if len(inprogress) != 1 {
+		t.Fatalf("entry and its aliases should be removed: %v", inprogress)
+	}
+	if _, ok := inprogress["other._http._tcp.local."]; !ok {
+		t.Fatalf("unrelated entry should be kept: %v", inprogress)
+	}
+}
+
+func TestClient_SharedMulticastPort(t *testing.T) {
+	c1, err := newClient(&QueryParam{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c1.Close()
+	c2, err := newClient(&QueryParam{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c2.Close()
+
+	if (c1.ipv4MulticastConn == nil) != (c2.ipv4MulticastConn == nil) {
+		t.Fatalf("both clients should bind the IPv4 multicast port")
+	}
+	if (c1.ipv6MulticastConn == nil) != (c2.ipv6MulticastConn == nil) {
+		t.Fatalf("both clients should bind the IPv6 multicast port")
+	}
+}
+
+func TestNewClient_BindErrors(t *testing.T) {
+	// A unicast address can't be joined as a multicast group
+	bad4 := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5353}
+	_, err := newClient(&QueryParam{DisableIPv6: true, IPv4Group: bad4})
+	bindErrs, ok := err.(BindErrors)
+	if !ok || len(bindErrs) != 1 {
+		t.Fatalf("expected bind errors, got: %v", err)
+	}
+	if e := bindErrs[0]; e.Network != "udp4" || !e.Multicast || e.Err == nil {
+		t.Fatalf("bad: %v", e)
+	}
+	if !errors.Is(err, ErrBindFailed) || !errors.Is(bindErrs[0], ErrBindFailed) {
+		t.Fatalf("expected ErrBindFailed, got: %v", err)
+	}
+
+	// A failure of one family is not fatal, but is reported
+	bad6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+	c, err := newClient(&QueryParam{IPv6Group: bad6})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if c.ipv4MulticastConn == nil {
+		t.Skip("IPv4 multicast is unavailable")
+	}
+	found := false
+	for _, e := range c.BindErrors() {
+		if e.Network == "udp6" && e.Multicast {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the udp6 multicast failure to be reported: %v", c.BindErrors())
+	}
+}
+
+func TestClient_Memberships(t *testing.T) {
+	c, err := newClient(&QueryParam{DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	memberships, err := c.Memberships()
+	if err != nil {
+		t.Skipf("multicast addresses are unavailable: %v", err)
+	}
+	if len(memberships) != 2 {
+		t.Fatalf("bad: %v", memberships)
+	}
+	m4, m6 := memberships[0], memberships[1]
+	if m4.Network != "udp4" || !m4.Bound || !m4.Group.IP.Equal(ipv4Addr.IP) {
+		t.Fatalf("bad: %+v", m4)
+	}
+	if len(m4.Ifaces) == 0 {
+		t.Fatalf("expected the group to be joined on an interface: %+v", m4)
+	}
+	if m6.Network != "udp6" || m6.Bound || len(m6.Ifaces) != 0 {
+		t.Fatalf("bad: %+v", m6)
+	}
+}
+
+func TestNewClient_ListenConfig(t *testing.T) {
+	var lock sync.Mutex
+	var bound []string
+	lc := &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		lock.Lock()
+		defer lock.Unlock()
+		bound = append(bound, network)
+		return nil
+	}}
+	c, err := newClient(&QueryParam{DisableIPv6: true, ListenConfig: lc})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.Close()
+	if len(bound) != 2 {
+		t.Fatalf("expected the unicast and multicast listeners to use the config, got: %v", bound)
+	}
+
+	// The bind fails rather than falling back to ignoring the config
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("refused")
+	}
+	if _, err := newClient(&QueryParam{DisableIPv6: true, ListenConfig: lc}); !errors.Is(err, ErrBindFailed) {
+		t.Fatalf("expected ErrBindFailed, got: %v", err)
+	}
+}
+
+func TestNewClient_SourcePort(t *testing.T) {
+	c, err := newClient(&QueryParam{SourcePort: mdnsPort, DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if port := c.ipv4UnicastConn.LocalAddr().(*net.UDPAddr).Port; port != mdnsPort {
+		t.Fatalf("expected queries to be sent from port %d, got %d", mdnsPort, port)
+	}
+
+	if _, err := newClient(&QueryParam{SourcePort: 1 << 16}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an invalid source port, got: %v", err)
+	}
+}
+
+func TestClient_Query_MulticastLoopback(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_loop._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	c, err := newClient(&QueryParam{DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	for _, on := range []bool{false, true} {
+		on := on
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Service:           "_loop._tcp",
+			Domain:            "local",
+			Timeout:           50 * time.Millisecond,
+			Entries:           entries,
+			DisableIPv6:       true,
+			MulticastLoopback: &on,
+		}
+		if err := c.Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		loop, err := ipv4.NewPacketConn(c.ipv4UnicastConn.(*net.UDPConn)).MulticastLoopback()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if loop != on {
+			t.Fatalf("expected multicast loopback %v, got %v", on, loop)
+		}
+
+		// The responder on this host only hears the query looped back
+		if found := len(entries) > 0; found != on {
+			t.Fatalf("loopback %v: expected found %v, got %v", on, on, found)
+		}
+	}
+}
+
+func TestClient_Query_ResetsSocketOptions(t *testing.T) {
+	c, err := newClient(&QueryParam{DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	conns := []*ipv4.PacketConn{
+		ipv4.NewPacketConn(c.ipv4UnicastConn.(*net.UDPConn)),
+		ipv4.NewPacketConn(c.ipv4MulticastConn.(*net.UDPConn)),
+	}
+	loopback := func() []bool {
+		var loops []bool
+		for _, p := range conns {
+			loop, err := p.MulticastLoopback()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			loops = append(loops, loop)
+		}
+		return loops
+	}
+	defaults := loopback()
+
+	// The multicast interface is also set when available, to check that it
+	// can be reset
+	var iface *net.Interface
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagUp != 0 && ifaces[i].Flags&net.FlagMulticast != 0 {
+			iface = &ifaces[i]
+			break
+		}
+	}
+
+	// A query of a reused client that leaves out the options goes back to
+	// the defaults, rather than keeping those of the previous query
+	on := !defaults[0]
+	query := func(iface *net.Interface, loop *bool) {
+		params := &QueryParam{
+			Service:           "_reset._tcp",
+			Domain:            "local",
+			Timeout:           10 * time.Millisecond,
+			Entries:           make(chan *ServiceEntry, 4),
+			DisableIPv6:       true,
+			Interface:         iface,
+			MulticastLoopback: loop,
+		}
+		if err := c.Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	query(iface, &on)
+	if loops := loopback(); loops[0] != on || loops[1] != on {
+		t.Fatalf("expected multicast loopback %v, got %v", on, loops)
+	}
+	query(nil, nil)
+	if loops := loopback(); !reflect.DeepEqual(loops, defaults) {
+		t.Fatalf("expected the default multicast loopback %v, got %v", defaults, loops)
+	}
+}
+
+func TestClient_Query_MulticastHops(t *testing.T) {
+	c, err := newClient(&QueryParam{DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	for _, test := range []struct {
+		hops, want int
+	}{
+		{0, 255},
+		{1, 1},
+	} {
+		params := &QueryParam{
+			Service:       "_hops._tcp",
+			Domain:        "local",
+			Timeout:       10 * time.Millisecond,
+			Entries:       make(chan *ServiceEntry, 4),
+			DisableIPv6:   true,
+			MulticastHops: test.hops,
+		}
+		if err := c.Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ttl, err := ipv4.NewPacketConn(c.ipv4UnicastConn.(*net.UDPConn)).MulticastTTL()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ttl != test.want {
+			t.Fatalf("hops %d: expected TTL %d, got %d", test.hops, test.want, ttl)
+		}
+	}
+
+	for _, hops := range []int{-1, 256} {
+		params := &QueryParam{
+			Service:       "_hops._tcp",
+			Entries:       make(chan *ServiceEntry, 4),
+			MulticastHops: hops,
+		}
+		if err := c.Query(params); err == nil {
+			t.Fatalf("expected an error for %d hops", hops)
+		}
+	}
+}
+
+func TestNewClient_LocalAddr(t *testing.T) {
+	c, err := newClient(&QueryParam{LocalAddr: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if ip := c.ipv4UnicastConn.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad local address: %v", ip)
+	}
+
+	if _, err := newClient(&QueryParam{LocalAddr: net.ParseIP("203.0.113.9")}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an address that isn't local, got: %v", err)
+	}
+	if _, err := newClient(&QueryParam{LocalAddr: net.IPv4(127, 0, 0, 1), DisableIPv4: true}); err == nil {
+		t.Fatalf("expected error for an address of a disabled family")
+	}
+}
+
+func TestNewClientWithConns(t *testing.T) {
+	if _, err := NewClientWithConns(nil, nil); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam without any listeners, got: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer responder.Close()
+
+	c, err := NewClientWithConns(conn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Answer directly to the provided listener
+	s := makeServiceWithServiceName(t, "_conns._tcp")
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = s.Records(dns.Question{Name: "_conns._tcp.local.", Qtype: dns.TypePTR})
+	buf, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		responder.WriteToUDP(buf, conn.LocalAddr().(*net.UDPAddr))
+	}()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_conns._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._conns._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestClient_Query_EmitPartial(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer responder.Close()
+
+	c, err := NewClientWithConns(conn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Send the pointer on its own, followed by the rest of the records
+	s := makeServiceWithServiceName(t, "_partial._tcp")
+	recs := s.Records(dns.Question{Name: "_partial._tcp.local.", Qtype: dns.TypePTR})
+	var bufs [][]byte
+	for _, answer := range [][]dns.RR{recs[:1], recs[1:]} {
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = answer
+		buf, err := resp.Pack()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		bufs = append(bufs, buf)
+	}
+	go func() {
+		for _, buf := range bufs {
+			time.Sleep(10 * time.Millisecond)
+			responder.WriteToUDP(buf, conn.LocalAddr().(*net.UDPAddr))
+		}
+	}()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_partial._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		EmitPartial: true,
+		Logger:      log.New(&bytes.Buffer{}, "", 0),
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected a partial and a complete entry, got %d", len(entries))
+	}
+	if e := <-entries; !e.Partial || e.Name != "hostname._partial._tcp.local." || e.Port != 0 {
+		t.Fatalf("bad partial entry: %v", e)
+	}
+	if e := <-entries; e.Partial || e.Port != 80 {
+		t.Fatalf("bad complete entry: %v", e)
+	}
+}
+
+func TestAssembler_AdditionalSections(t *testing.T) {
+	s := makeServiceWithServiceName(t, "_sections._tcp")
+	recs := s.Records(dns.Question{Name: "_sections._tcp.local.", Qtype: dns.TypePTR})
+
+	// Mimic a responder that only puts the PTR in the answer section, and
+	// splits the remaining records between the other sections
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = recs[:1]
+	resp.Ns = recs[1:3]
+	resp.Extra = recs[3:]
+
+	params := &QueryParam{}
+	a := newAssembler([]queriedService{{addr: "_sections._tcp.local."}}, params)
+	updated := a.handleResponse(&packet{msg: resp})
+	if len(updated) != 1 || !updated[0].complete() {
+		t.Fatalf("entry should be complete: %v", updated)
+	}
+	inp := updated[0]
+	if inp.Port != 80 || inp.AddrV4 == nil || inp.Info != "Local web server" {
+		t.Fatalf("bad: %v", inp)
+	}
+	if inp.Priority != 10 || inp.Weight != 1 {
+		t.Fatalf("bad SRV priority and weight: %d, %d", inp.Priority, inp.Weight)
+	}
+}
+
+func TestResolveInterface(t *testing.T) {
+	if iface, err := resolveInterface(&QueryParam{}); iface != nil || err != nil {
+		t.Fatalf("expected the system default, got %v, %v", iface, err)
+	}
+
+	if _, err := resolveInterface(&QueryParam{InterfaceName: "does-not-exist0"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing interface name, got: %v", err)
+	}
+	if _, err := resolveInterface(&QueryParam{InterfaceIndex: 1 << 20}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing interface index, got: %v", err)
+	}
+	down := &net.Interface{Index: 1 << 20, Name: "down0", Flags: net.FlagMulticast}
+	if _, err := resolveInterface(&QueryParam{Interface: down}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an interface that is down, got: %v", err)
+	}
+	if err := Query(&QueryParam{Service: "_down._tcp", Interface: down}); err == nil {
+		t.Fatalf("expected the query to fail before binding")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, want := range ifaces {
+		byName, nameErr := resolveInterface(&QueryParam{InterfaceName: want.Name})
+		byIndex, indexErr := resolveInterface(&QueryParam{InterfaceIndex: want.Index})
+		_, ifaceErr := resolveInterface(&QueryParam{Interface: &ifaces[i]})
+		if want.Flags&net.FlagMulticast == 0 || want.Flags&net.FlagUp == 0 {
+			if nameErr == nil || indexErr == nil || ifaceErr == nil {
+				t.Fatalf("expected error for unusable interface %s", want.Name)
+			}
+			continue
+		}
+		if nameErr != nil || indexErr != nil || ifaceErr != nil {
+			t.Fatalf("interface %s: %v, %v, %v", want.Name, nameErr, indexErr, ifaceErr)
+		}
+		if byName.Index != want.Index || byIndex.Name != want.Name {
+			t.Fatalf("interface %s resolved to %v and %v", want.Name, byName, byIndex)
+		}
+	}
+}
+
+func TestClient_Query_MaxEntries(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_max._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:    "_max._tcp",
+		Domain:     "local",
+		Timeout:    5 * time.Second,
+		Entries:    entries,
+		MaxEntries: 1,
+	}
+	start := time.Now()
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("query should return once enough entries are found, took %v", elapsed)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+}
+
+func TestClient_Query_MaxEntries_Distinct(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		zone, err := NewMDNSService(fmt.Sprintf("host%d", i), "_maxof._tcp", "local.", "testhost.", 80+i,
+			[]net.IP{net.IPv4(192, 168, 0, byte(i+1))}, []string{"Local web server"})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		serv, err := NewServer(&Config{Zone: zone})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer serv.Shutdown()
+	}
+
+	// Each responder answers every copy of the query, so duplicates of the
+	// entries found first must not count towards the limit
+	entries := make(chan *ServiceEntry, 16)
+	params := &QueryParam{
+		Service:    "_maxof._tcp",
+		Domain:     "local",
+		Timeout:    5 * time.Second,
+		Entries:    entries,
+		Retries:    3,
+		MaxEntries: 3,
+	}
+	start := time.Now()
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("query should return once enough entries are found, took %v", elapsed)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	seen := make(map[string]bool)
+	for len(entries) > 0 {
+		e := <-entries
+		if seen[e.Name] {
+			t.Fatalf("duplicate entry: %v", e)
+		}
+		seen[e.Name] = true
+	}
+}
+
+func TestClient_Query_UnicastAddr(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer responder.Close()
+
+	// Answer the first question with the records of the zone
+	s := makeServiceWithServiceName(t, "_direct._tcp")
+	go func() {
+		buf := make([]byte, 65536)
+		n, from, err := responder.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(&query)
+		resp.Answer = s.Records(query.Question[0])
+		out, _ := resp.Pack()
+		responder.WriteToUDP(out, from)
+	}()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_direct._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		UnicastAddr: responder.LocalAddr().(*net.UDPAddr),
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._direct._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestClient_Query_QueryClass(t *testing.T) {
+	s, err := NewMDNSService("hostname", "_class._tcp", "local.", "testhost.", 80,
+		[]net.IP{net.IP([]byte{192, 168, 0, 42})}, []string{"Local web server"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	query := func(class uint16) int {
+		responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer responder.Close()
+
+		// Only answer questions in the chaos class, keeping the unicast
+		// response bit out of the comparison
+		go func() {
+			buf := make([]byte, 65536)
+			n, from, err := responder.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dns.Msg
+			if err := query.Unpack(buf[:n]); err != nil {
+				return
+			}
+			q := query.Question[0]
+			if q.Qclass&^(1<<15) != dns.ClassCHAOS || q.Qclass&(1<<15) == 0 {
+				return
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(&query)
+			resp.Answer = s.Records(q)
+			out, _ := resp.Pack()
+			responder.WriteToUDP(out, from)
+		}()
+
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Service:             "_class._tcp",
+			Domain:              "local",
+			Timeout:             50 * time.Millisecond,
+			Entries:             entries,
+			UnicastAddr:         responder.LocalAddr().(*net.UDPAddr),
+			QueryClass:          class,
+			WantUnicastResponse: true,
+		}
+		if err := Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return len(entries)
+	}
+
+	if n := query(0); n != 0 {
+		t.Fatalf("expected no entries for the default class, got %d", n)
+	}
+	if n := query(dns.ClassCHAOS); n != 1 {
+		t.Fatalf("expected 1 entry for the chaos class, got %d", n)
+	}
+}
+
+func TestClient_Query_UDPSize(t *testing.T) {
+	// A service with more TXT than fits in a 512 byte response
+	txt := make([]string, 20)
+	for i := range txt {
+		txt[i] = fmt.Sprintf("key%d=%s", i, strings.Repeat("v", 40))
+	}
+	s, err := NewMDNSService("hostname", "_edns._tcp", "local.", "testhost.", 80,
+		[]net.IP{net.IP([]byte{192, 168, 0, 42})}, txt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	query := func(udpSize uint16) int {
+		responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer responder.Close()
+
+		// Answer with every record if the querier advertised room for
+		// them, and otherwise just the pointer, marked as truncated
+		go func() {
+			buf := make([]byte, 65536)
+			n, from, err := responder.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dns.Msg
+			if err := query.Unpack(buf[:n]); err != nil {
+				return
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(&query)
+			resp.Answer = s.Records(query.Question[0])
+			if opt := query.IsEdns0(); opt == nil || int(opt.UDPSize()) < resp.Len() {
+				resp.Answer = resp.Answer[:1]
+				resp.Truncated = true
+			}
+			out, _ := resp.Pack()
+			responder.WriteToUDP(out, from)
+		}()
+
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Service:     "_edns._tcp",
+			Domain:      "local",
+			Timeout:     50 * time.Millisecond,
+			Entries:     entries,
+			UnicastAddr: responder.LocalAddr().(*net.UDPAddr),
+			UDPSize:     udpSize,
+		}
+		if err := Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return len(entries)
+	}
+
+	if n := query(0); n != 0 {
+		t.Fatalf("expected the response to be truncated without EDNS0, got %d entries", n)
+	}
+	if n := query(4096); n != 1 {
+		t.Fatalf("expected 1 entry with EDNS0, got %d", n)
+	}
+}
+
+func TestClient_Query_Truncated(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer responder.Close()
+
+	c, err := NewClientWithConns(conn, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Send the records split over a truncated packet, which ends part way
+	// through the TXT record, and a continuation carrying the TXT
+	s := makeServiceWithServiceName(t, "_truncated._tcp")
+	recs := s.Records(dns.Question{Name: "_truncated._tcp.local.", Qtype: dns.TypePTR})
+	first := new(dns.Msg)
+	first.Response = true
+	first.Truncated = true
+	first.Answer = recs
+	buf1, err := first.Pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf1 = buf1[:len(buf1)-4]
+
+	rest := new(dns.Msg)
+	rest.Response = true
+	rest.Answer = recs[len(recs)-1:]
+	buf2, err := rest.Pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		responder.WriteToUDP(buf1, conn.LocalAddr().(*net.UDPAddr))
+		responder.WriteToUDP(buf2, conn.LocalAddr().(*net.UDPAddr))
+	}()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_truncated._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Port != 80 || e.Info != "Local web server" {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestAssembler_MultipleInstances(t *testing.T) {
+	// Two instances on the same host, advertised in a single packet
+	var recs []dns.RR
+	for _, instance := range []string{"first", "second"} {
+		s, err := NewMDNSService(instance, "_multi._tcp", "local.", "testhost.", 80,
+			[]net.IP{net.IP([]byte{192, 168, 0, 42})}, []string{instance})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		recs = append(recs, s.Records(dns.Question{Name: "_multi._tcp.local.", Qtype: dns.TypePTR})...)
+	}
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = recs
+
+	a := newAssembler([]queriedService{{addr: "_multi._tcp.local."}}, &QueryParam{})
+	complete := make(map[string]*ServiceEntry)
+	for _, inp := range a.handleResponse(&packet{msg: resp}) {
+		if inp.complete() {
+			complete[inp.Name] = inp
+		}
+	}
+	if len(complete) != 2 {
+		t.Fatalf("expected 2 complete entries, got %v", complete)
+	}
+	for _, instance := range []string{"first", "second"} {
+		inp := complete[instance+"._multi._tcp.local."]
+		if inp == nil || inp.Info != instance || inp.AddrV4 == nil {
+			t.Fatalf("bad entry for %s: %v", instance, inp)
+		}
+	}
+}
+
+func TestAssembler_GoodbyeKeepsOthers(t *testing.T) {
+	// Two instances on the same host, one of which says goodbye
+	announcement := make(map[string][]dns.RR)
+	for _, instance := range []string{"first", "second"} {
+		s, err := NewMDNSService(instance, "_bye._tcp", "local.", "testhost.", 80,
+			[]net.IP{net.IP([]byte{192, 168, 0, 42})}, []string{instance})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		announcement[instance] = s.Records(dns.Question{Name: "_bye._tcp.local.", Qtype: dns.TypePTR})
+	}
+	a := newAssembler([]queriedService{{addr: "_bye._tcp.local."}}, &QueryParam{})
+	announce := func(recs ...dns.RR) []*ServiceEntry {
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = recs
+		return a.handleResponse(&packet{msg: resp})
+	}
+	announce(announcement["first"]...)
+	announce(announcement["second"]...)
+
+	goodbye := dns.Copy(announcement["second"][0]).(*dns.PTR)
+	goodbye.Hdr.Ttl = 0
+	announce(goodbye)
+
+	// The remaining instance's unchanged announcement isn't an update
+	if updated := announce(announcement["first"]...); len(updated) != 0 {
+		t.Fatalf("expected no updates for the remaining instance, got %v", updated)
+	}
+
+	// The instance that left is assembled afresh when it returns
+	updated := announce(announcement["second"]...)
+	if len(updated) != 1 || updated[0].Name != "second._bye._tcp.local." || !updated[0].complete() {
+		t.Fatalf("expected the returning instance to be complete, got %v", updated)
+	}
+}
+
+func TestAssembler_Match(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	for _, service := range []string{"_first._tcp", "_second._tcp", "_third._tcp"} {
+		s := makeServiceWithServiceName(t, service)
+		resp.Answer = append(resp.Answer, s.Records(dns.Question{Name: service + ".local.", Qtype: dns.TypePTR})[0])
+	}
+
+	// Accept pointers for either of two related services, and everything
+	// else as usual
+	params := &QueryParam{
+		Match: func(rr dns.RR) bool {
+			ptr, ok := rr.(*dns.PTR)
+			return !ok || ptr.Hdr.Name == "_first._tcp.local." || ptr.Hdr.Name == "_second._tcp.local."
+		},
+	}
+	a := newAssembler([]queriedService{{addr: "_first._tcp.local."}}, params)
+	var names []string
+	for _, inp := range a.handleResponse(&packet{msg: resp}) {
+		names = append(names, inp.Name)
+	}
+	want := []string{"hostname._first._tcp.local.", "hostname._second._tcp.local."}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+}
+
+// extraZone adds an unrelated record to each answer
+type extraZone struct {
+	Zone
+}
+
+func (e *extraZone) Records(q dns.Question) []dns.RR {
+	recs := e.Zone.Records(q)
+	if len(recs) == 0 {
+		return nil
+	}
+	return append(recs, &dns.A{
+		Hdr: dns.RR_Header{Name: "otherhost.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.168.0.7"),
+	})
+}
+
+func TestClient_Query_NoFilter(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: &extraZone{Zone: makeServiceWithServiceName(t, "_nofilter._tcp")}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 16)
+	params := &QueryParam{
+		Service:     "_nofilter._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+		NoFilter:    true,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The unrelated host is streamed as a partial entry of its own, along
+	// with the instance
+	var instance, other bool
+	for len(entries) > 0 {
+		e := <-entries
+		switch {
+		case e.Name == "hostname._nofilter._tcp.local." && !e.Partial:
+			instance = true
+		case e.Name == "otherhost.local." && e.Partial:
+			other = true
+		}
+	}
+	if !instance || !other {
+		t.Fatalf("expected both the instance and the other host, got instance %v, other %v", instance, other)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(10)
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if r.allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Fatalf("expected a burst of 10 to be allowed, got %d", allowed)
+	}
+
+	// Tokens are refilled over time, up to the burst
+	if !r.allow(now.Add(100*time.Millisecond)) || r.allow(now.Add(100*time.Millisecond)) {
+		t.Fatalf("expected a single event to be allowed after 100ms")
+	}
+	allowed = 0
+	for i := 0; i < 20; i++ {
+		if r.allow(now.Add(time.Hour)) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Fatalf("expected the burst to be capped at 10, got %d", allowed)
+	}
+
+	// A negative rate is unlimited
+	r = newRateLimiter(-1)
+	for i := 0; i < 100; i++ {
+		if !r.allow(now) {
+			t.Fatalf("expected no limit")
+		}
+	}
+}
+
+func TestClient_Query_MaxPacketRate(t *testing.T) {
+	conn := newMemConn(func(b []byte) []byte { return nil })
+	for i := 0; i < cap(conn.in); i++ {
+		conn.in <- []byte{0}
+	}
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	stats := &Stats{}
+	params := &QueryParam{
+		Service:       "_flood._tcp",
+		Domain:        "local",
+		Timeout:       50 * time.Millisecond,
+		Entries:       make(chan *ServiceEntry, 4),
+		DisableIPv6:   true,
+		MaxPacketRate: 4,
+		Stats:         stats,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.PacketsReceived != uint64(cap(conn.in)) || stats.ParseFailures != 4 {
+		t.Fatalf("expected 4 of %d packets to be unpacked: %+v", cap(conn.in), stats)
+	}
+	if stats.PacketsDropped != stats.PacketsReceived-4 {
+		t.Fatalf("expected the excess to be dropped: %+v", stats)
+	}
+}
+
+func TestDrainPackets(t *testing.T) {
+	msgCh := make(chan *packet, 4)
+	for i := 0; i < 3; i++ {
+		msgCh <- &packet{msg: new(dns.Msg)}
+	}
+
+	// Every buffered packet is handled, without waiting for more
+	handled := 0
+	drainPackets(msgCh, func(*packet) bool {
+		handled++
+		return false
+	})
+	if handled != 3 || len(msgCh) != 0 {
+		t.Fatalf("expected 3 packets to be handled, got %d with %d left", handled, len(msgCh))
+	}
+
+	// Draining stops once the handler is done
+	msgCh <- &packet{msg: new(dns.Msg)}
+	msgCh <- &packet{msg: new(dns.Msg)}
+	handled = 0
+	drainPackets(msgCh, func(*packet) bool {
+		handled++
+		return true
+	})
+	if handled != 1 || len(msgCh) != 1 {
+		t.Fatalf("expected draining to stop after 1 packet, got %d with %d left", handled, len(msgCh))
+	}
+}
+
+func TestAssemblerFor_PerInterface(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = makeServiceWithServiceName(t, "_perif._tcp").Records(dns.Question{Name: "_perif._tcp.local.", Qtype: dns.TypePTR})
+	eth0 := &net.Interface{Index: 2, Name: "eth0"}
+	eth1 := &net.Interface{Index: 3, Name: "eth1"}
+	services := []queriedService{{addr: "_perif._tcp.local."}}
+
+	for _, perInterface := range []bool{false, true} {
+		params := &QueryParam{Domain: "local", PerInterface: perInterface}
+		assemblers := make(map[int]*assembler)
+		var complete []*ServiceEntry
+		for _, iface := range []*net.Interface{eth0, eth1} {
+			pkt := &packet{msg: resp, iface: iface}
+			for _, inp := range assemblerFor(assemblers, pkt, services, params).handleResponse(pkt) {
+				if inp.complete() {
+					complete = append(complete, inp)
+				}
+			}
+		}
+
+		// Merged, the second response is a duplicate of the first
+		if !perInterface {
+			if len(complete) != 1 {
+				t.Fatalf("expected a single merged entry, got %v", complete)
+			}
+			continue
+		}
+		if len(complete) != 2 || complete[0] == complete[1] ||
+			complete[0].Iface != eth0 || complete[1].Iface != eth1 {
+			t.Fatalf("expected an entry per interface, got %v", complete)
+		}
+	}
+}
+
+func TestAssembler_NoFilter(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = makeServiceWithServiceName(t, "_other._tcp").Records(dns.Question{Name: "_other._tcp.local.", Qtype: dns.TypePTR})[:1]
+
+	a := newAssembler([]queriedService{{addr: "_first._tcp.local."}}, &QueryParam{NoFilter: true})
+	if updated := a.handleResponse(&packet{msg: resp}); len(updated) != 1 || updated[0].Name != "hostname._other._tcp.local." {
+		t.Fatalf("bad: %v", updated)
+	}
+}
+
+func TestAssembler_Matches_Subdomain(t *testing.T) {
+	ptr := func(owner string) *dns.PTR {
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: "hostname._http._tcp.local.",
+		}
+	}
+
+	// Instances of a subtype are instances of the service
+	services, err := queryServices(&QueryParam{Service: "_http._tcp", Domain: "local"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a := newAssembler(services, &QueryParam{})
+	for _, owner := range []string{"_http._tcp.local.", "_printer._sub._HTTP._tcp.local."} {
+		if !a.matches(ptr(owner)) {
+			t.Fatalf("expected %s to match", owner)
+		}
+	}
+	for _, owner := range []string{"_ipp._tcp.local.", "_tcp.local.", "x_http._tcp.local."} {
+		if a.matches(ptr(owner)) {
+			t.Fatalf("expected %s not to match", owner)
+		}
+	}
+
+	// A subtype only matches itself
+	services, err = queryServices(&QueryParam{Service: "_http._tcp", Subtype: "_printer", Domain: "local"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a = newAssembler(services, &QueryParam{})
+	if !a.matches(ptr("_printer._sub._http._tcp.local.")) || a.matches(ptr("_x._printer._sub._http._tcp.local.")) {
+		t.Fatalf("expected only the subtype queried to match")
+	}
+}
+
+func TestAssembler_StrictSRVTarget(t *testing.T) {
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 120}
+	}
+	respond := func(a *assembler, answers ...dns.RR) {
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = answers
+		a.handleResponse(&packet{msg: resp})
+	}
+	const instance = "hostname._strict._tcp.local."
+
+	for _, strict := range []bool{false, true} {
+		a := newAssembler([]queriedService{{addr: "_strict._tcp.local."}}, &QueryParam{StrictSRVTarget: strict})
+		respond(a,
+			&dns.A{Hdr: hdr(instance, dns.TypeA), A: net.ParseIP("192.168.0.1")},
+			&dns.SRV{Hdr: hdr(instance, dns.TypeSRV), Target: "realhost.local.", Port: 80},
+			&dns.A{Hdr: hdr("otherhost.local.", dns.TypeA), A: net.ParseIP("192.168.0.2")},
+		)
+		inp := a.inprogress[instance]
+		if strict && inp.AddrV4 != nil {
+			t.Fatalf("expected the instance's own address record to be ignored, got %v", inp.AddrV4)
+		}
+		if !strict && !inp.AddrV4.Equal(net.ParseIP("192.168.0.1")) {
+			t.Fatalf("expected the instance's own address record to be used, got %v", inp.AddrV4)
+		}
+
+		// The target's addresses are used once they arrive
+		respond(a, &dns.A{Hdr: hdr("realhost.local.", dns.TypeA), A: net.ParseIP("192.168.0.3")})
+		if !inp.AddrV4.Equal(net.ParseIP("192.168.0.3")) {
+			t.Fatalf("expected the target's address, got %v", inp.AddrV4)
+		}
+	}
+
+	// A new target's addresses replace the old target's
+	a := newAssembler([]queriedService{{addr: "_strict._tcp.local."}}, &QueryParam{StrictSRVTarget: true})
+	respond(a,
+		&dns.SRV{Hdr: hdr(instance, dns.TypeSRV), Target: "realhost.local.", Port: 80},
+		&dns.A{Hdr: hdr("realhost.local.", dns.TypeA), A: net.ParseIP("192.168.0.3")},
+	)
+	respond(a, &dns.SRV{Hdr: hdr(instance, dns.TypeSRV), Target: "newhost.local.", Port: 80})
+	if inp := a.inprogress[instance]; inp.AddrV4 != nil {
+		t.Fatalf("expected the old target's address to be dropped, got %v", inp.AddrV4)
+	}
+	respond(a, &dns.A{Hdr: hdr("realhost.local.", dns.TypeA), A: net.ParseIP("192.168.0.4")})
+	if inp := a.inprogress[instance]; inp.AddrV4 != nil {
+		t.Fatalf("expected the old target's records to be ignored, got %v", inp.AddrV4)
+	}
+}
+
+func TestAssembler_Matches_QueryTypes(t *testing.T) {
+	hinfo := &dns.HINFO{
+		Hdr: dns.RR_Header{Name: "testhost.local.", Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 120},
+		Cpu: "ARM",
+		Os:  "Linux",
+	}
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "testhost.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.168.0.1"),
+	}
+	for _, test := range []struct {
+		types []uint16
+		hinfo bool
+	}{
+		{nil, true},
+		{[]uint16{dns.TypePTR}, false},
+		{[]uint16{dns.TypePTR, dns.TypeHINFO}, true},
+		{[]uint16{dns.TypeANY}, true},
+	} {
+		as := newAssembler([]queriedService{{addr: "_types._tcp.local."}}, &QueryParam{QueryTypes: test.types})
+		if as.matches(hinfo) != test.hinfo {
+			t.Fatalf("%v: expected HINFO matching to be %v", test.types, test.hinfo)
+		}
+		if !as.matches(a) {
+			t.Fatalf("%v: expected address records to always match", test.types)
+		}
+	}
+}
+
+func TestAssembler_CacheFlush(t *testing.T) {
+	a := newAssembler([]queriedService{{addr: "_flush._tcp.local."}}, &QueryParam{})
+	announce := func(ip string) *ServiceEntry {
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "testhost.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: 120},
+			A:   net.ParseIP(ip),
+		}}
+		a.handleResponse(&packet{msg: resp})
+		return a.inprogress["testhost.local."]
+	}
+
+	// The host moves to a new address and back again, which should not be
+	// ignored as a duplicate of the first announcement
+	announce("192.168.0.1")
+	announce("192.168.0.2")
+	if inp := announce("192.168.0.1"); !inp.AddrV4.Equal(net.ParseIP("192.168.0.1")) {
+		t.Fatalf("expected the flushed address to be replaced, got %v", inp.AddrV4)
+	}
+
+	// Records in the same response don't flush each other
+	resp := new(dns.Msg)
+	resp.Response = true
+	for _, ip := range []string{"192.168.0.3", "192.168.0.4"} {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "testhost.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: 120},
+			A:   net.ParseIP(ip),
+		})
+	}
+	a.handleResponse(&packet{msg: resp})
+	if n := len(a.seen[rrset{"testhost.local.", dns.TypeA}]); n != 2 {
+		t.Fatalf("expected both records of the response to be known, got %d", n)
+	}
+}
+
+func TestAssembler_NSEC(t *testing.T) {
+	for _, test := range []struct {
+		host     bool
+		types    []uint16
+		complete bool
+	}{
+		{false, []uint16{dns.TypeSRV}, true},
+		{false, []uint16{dns.TypeSRV, dns.TypeTXT}, false},
+
+		// The host's records don't say whether the instance has a TXT record
+		{true, []uint16{dns.TypeA, dns.TypeAAAA}, false},
+	} {
+		s := makeServiceWithServiceName(t, "_nsec._tcp")
+		recs := s.Records(dns.Question{Name: "_nsec._tcp.local.", Qtype: dns.TypePTR})
+
+		// Leave out the TXT record, saying whether it exists with an NSEC
+		owner := s.instanceAddr
+		if test.host {
+			owner = s.HostName
+		}
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = recs[:len(recs)-1]
+		resp.Extra = []dns.RR{&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 120},
+			NextDomain: owner,
+			TypeBitMap: test.types,
+		}}
+
+		a := newAssembler([]queriedService{{addr: "_nsec._tcp.local."}}, &QueryParam{})
+		a.handleResponse(&packet{msg: resp})
+		inp := a.inprogress[s.instanceAddr]
+		if inp == nil || inp.complete() != test.complete {
+			t.Fatalf("NSEC of %s for %v: expected complete to be %v: %v", owner, test.types, test.complete, inp)
+		}
+	}
+}
+
+func TestAssembler_LinkLocalZone(t *testing.T) {
+	s, err := NewMDNSService("hostname", "_zone._tcp", "local.", "testhost.", 80,
+		[]net.IP{net.ParseIP("fe80::1")}, []string{"Local web server"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = s.Records(dns.Question{Name: "_zone._tcp.local.", Qtype: dns.TypePTR})
+
+	a := newAssembler([]queriedService{{addr: "_zone._tcp.local."}}, &QueryParam{})
+	updated := a.handleResponse(&packet{msg: resp, iface: &net.Interface{Index: 2, Name: "eth0"}})
+	if len(updated) != 1 || !updated[0].complete() {
+		t.Fatalf("entry should be complete: %v", updated)
+	}
+	inp := updated[0]
+	if inp.AddrV6Zone != "eth0" {
+		t.Fatalf("bad zone: %q", inp.AddrV6Zone)
+	}
+	if got := inp.AddrV6Host(); got != "fe80::1%eth0" {
+		t.Fatalf("bad host: %q", got)
+	}
+
+	// Global addresses don't need a zone
+	global := &ServiceEntry{AddrV6: net.ParseIP("2001:db8::1")}
+	if got := global.AddrV6Host(); got != "2001:db8::1" {
+		t.Fatalf("bad host: %q", got)
+	}
+	if got := (&ServiceEntry{}).AddrV6Host(); got != "" {
+		t.Fatalf("bad host: %q", got)
+	}
+}
+
+func TestClient_Query_Subtype(t *testing.T) {
+	params := &QueryParam{
+		Service: "_http._tcp",
+		Domain:  "local",
+		Subtype: "_printer",
+	}
+	serviceAddr := queryName(params)
+	if serviceAddr != "_printer._sub._http._tcp.local." {
+		t.Fatalf("bad: %v", serviceAddr)
+	}
+
+	// Respond with the subtype pointer rather than the service pointer
+	s := makeService(t)
+	recs := s.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})
+	recs[0].Header().Name = serviceAddr
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = recs
+
+	a := newAssembler([]queriedService{{addr: serviceAddr}}, params)
+	updated := a.handleResponse(&packet{msg: resp})
+	if len(updated) != 1 || !updated[0].complete() {
+		t.Fatalf("entry should be complete: %v", updated)
+	}
+	inp := updated[0]
+	if inp.Name != "hostname._http._tcp.local." {
+		t.Fatalf("bad: %v", inp)
+	}
+
+	// An unrelated service pointer is ignored
+	a = newAssembler([]queriedService{{addr: serviceAddr}}, params)
+	resp.Answer = s.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})[:1]
+	if updated := a.handleResponse(&packet{msg: resp}); len(updated) != 0 {
+		t.Fatalf("expected no entry: %v", updated)
+	}
+}
+
+func TestClient_RecvBufferSize(t *testing.T) {
+	c, err := newClient(&QueryParam{RecvBufferSize: 1500})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	if buf := c.bufPool.Get().(*[]byte); len(*buf) != 1500 {
+		t.Fatalf("bad buffer size: %d", len(*buf))
+	}
+}
+
+func TestIsLocalSource(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	networks := []*net.IPNet{lan}
+	for _, test := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"127.0.0.1", true},
+		{"169.254.10.1", true},
+		{"fe80::1", true},
+		{"::1", true},
+		{"192.168.2.20", false},
+		{"203.0.113.5", false},
+		{"2001:db8::1", false},
+	} {
+		if got := isLocalSource(net.ParseIP(test.ip), networks); got != test.want {
+			t.Errorf("isLocalSource(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestSourceFilter(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 5353}
+	params := &QueryParam{Logger: log.Default()}
+	if accept := newSourceFilter(params); accept == nil || accept(remote) {
+		t.Fatalf("expected a remote source to be dropped")
+	}
+
+	params.UnicastAddr = remote
+	if accept := newSourceFilter(params); accept == nil || !accept(remote) {
+		t.Fatalf("expected the unicast responder to be accepted")
+	}
+
+	params = &QueryParam{AllowRemoteResponses: true}
+	if accept := newSourceFilter(params); accept != nil {
+		t.Fatalf("expected no filter when remote responses are allowed")
+	}
+}
+
+func BenchmarkClient_StartRecv(b *testing.B) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(conn, nil)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _, stop := c.startRecv(time.Now().Add(time.Hour), nil, nil)
+		stop()
+	}
+}
+
+// benchmarkResponse returns a response advertising several instances, as
+// seen during an announcement storm
+func benchmarkResponse(b *testing.B) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Response = true
+	for i := 0; i < 8; i++ {
+		s, err := NewMDNSService(fmt.Sprintf("instance%d", i), "_bench._tcp", "local.",
+			fmt.Sprintf("host%d.", i), 80, []net.IP{net.IP([]byte{192, 168, 0, byte(i)})},
+			[]string{"Local web server"})
+		if err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		resp.Answer = append(resp.Answer, s.Records(dns.Question{Name: "_bench._tcp.local.", Qtype: dns.TypePTR})...)
+	}
+	return resp
+}
+
+func BenchmarkAssembler_HandleResponse(b *testing.B) {
+	pkt := &packet{msg: benchmarkResponse(b)}
+	a := newAssembler([]queriedService{{addr: "_bench._tcp.local."}}, &QueryParam{})
+
+	// Repeated announcements of records that were already seen
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.handleResponse(pkt)
+	}
+}
+
+func BenchmarkAssembler_HandleResponse_AllowDuplicates(b *testing.B) {
+	pkt := &packet{msg: benchmarkResponse(b)}
+	a := newAssembler([]queriedService{{addr: "_bench._tcp.local."}}, &QueryParam{AllowDuplicates: true})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.handleResponse(pkt)
+	}
+}
+
+// memConn is an in-memory listener, which answers each packet written to it
+// with the packet returned by respond, if any
+type memConn struct {
+	respond func(b []byte) []byte
+	in      chan []byte
+
+	lock     sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // Closed when the deadline changes
+	closed   bool
+}
+
+// memTimeout is returned by reads from a memConn past its deadline
+type memTimeout struct{}
+
+func (memTimeout) Error() string   { return "i/o timeout" }
+func (memTimeout) Timeout() bool   { return true }
+func (memTimeout) Temporary() bool { return true }
+
+// memSource is the address packets read from a memConn are from
+var memSource = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: mdnsPort}
+
+func newMemConn(respond func(b []byte) []byte) *memConn {
+	return &memConn{respond: respond, in: make(chan []byte, 16), wake: make(chan struct{})}
+}
+
+func (m *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		m.lock.Lock()
+		deadline, wake, closed := m.deadline, m.wake, m.closed
+		m.lock.Unlock()
+		if closed {
+			return 0, nil, net.ErrClosed
+		}
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, memTimeout{}
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case buf := <-m.in:
+			return copy(b, buf), memSource, nil
+		case <-timeout:
+			return 0, nil, memTimeout{}
+		case <-wake:
+		}
+	}
+}
+
+func (m *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if out := m.respond(b); out != nil {
+		m.in <- out
+	}
+	return len(b), nil
+}
+
+func (m *memConn) SetReadDeadline(t time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deadline = t
+	close(m.wake)
+	m.wake = make(chan struct{})
+	return nil
+}
+
+func (m *memConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (m *memConn) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.wake)
+		m.wake = make(chan struct{})
+	}
+	return nil
+}
+
+// zoneResponder returns a memConn response function answering queries from
+// the zone
+func zoneResponder(zone Zone) func(b []byte) []byte {
+	s := &Server{config: &Config{Zone: zone}}
+	return func(b []byte) []byte {
+		var query dns.Msg
+		if err := query.Unpack(b); err != nil || query.Response {
+			return nil
+		}
+		resp := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Authoritative: true}}
+		for _, q := range query.Question {
+			mrecs, urecs := s.handleQuestion(q)
+			resp.Answer = append(resp.Answer, append(mrecs, urecs...)...)
+		}
+		if len(resp.Answer) == 0 {
+			return nil
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			return nil
+		}
+		return out
+	}
+}
+
+func TestClient_Query_MemConn(t *testing.T) {
+	conn := newMemConn(zoneResponder(makeServiceWithServiceName(t, "_mem._tcp")))
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_mem._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	e := <-entries
+	if e.Name != "hostname._mem._tcp.local." || e.Port != 80 || !e.AddrV4.Equal(net.IPv4(192, 168, 0, 42)) {
+		t.Fatalf("bad: %v", e)
+	}
+	if e.Iface != nil || !e.SrcAddr.Equal(memSource.IP) {
+		t.Fatalf("bad source: %v %v", e.Iface, e.SrcAddr)
+	}
+}
+
+func TestClient_Query_InitialDelay(t *testing.T) {
+	var sentAt time.Time
+	respond := zoneResponder(makeServiceWithServiceName(t, "_delay._tcp"))
+	conn := newMemConn(func(b []byte) []byte {
+		if sentAt.IsZero() {
+			sentAt = time.Now()
+		}
+		return respond(b)
+	})
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:      "_delay._tcp",
+		Domain:       "local",
+		Timeout:      200 * time.Millisecond,
+		Entries:      entries,
+		DisableIPv6:  true,
+		InitialDelay: 60 * time.Millisecond,
+	}
+	start := time.Now()
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := sentAt.Sub(start); d < 10*time.Millisecond {
+		t.Fatalf("expected the query to be delayed, sent after %v", d)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+}
+
+// upperZone capitalizes the service in its pointers and the host in its
+// address records, unlike in the records of the instance
+type upperZone struct {
+	Zone
+}
+
+func (u *upperZone) Records(q dns.Question) []dns.RR {
+	recs := u.Zone.Records(q)
+	for i, rr := range recs {
+		rr = dns.Copy(rr)
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			rr.Hdr.Name = strings.Replace(rr.Hdr.Name, "_mixed._tcp", "_MIXED._TCP", 1)
+			rr.Ptr = strings.Replace(rr.Ptr, "_mixed._tcp", "_MIXED._TCP", 1)
+		case *dns.A, *dns.AAAA:
+			rr.Header().Name = strings.ToUpper(rr.Header().Name)
+		}
+		recs[i] = rr
+	}
+	return recs
+}
+
+func TestClient_Query_MixedCase(t *testing.T) {
+	conn := newMemConn(zoneResponder(&upperZone{Zone: makeServiceWithServiceName(t, "_mixed._tcp")}))
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_mixed._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if e := <-entries; !strings.EqualFold(e.Name, "hostname._mixed._tcp.local.") || e.Port != 80 || !e.AddrV4.Equal(net.IPv4(192, 168, 0, 42)) {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+// txtOnlyZone only answers with the pointer and TXT records of its zone
+type txtOnlyZone struct {
+	Zone
+}
+
+func (z *txtOnlyZone) Records(q dns.Question) []dns.RR {
+	var recs []dns.RR
+	for _, rr := range z.Zone.Records(q) {
+		switch rr.Header().Rrtype {
+		case dns.TypePTR, dns.TypeTXT:
+			recs = append(recs, rr)
+		}
+	}
+	return recs
+}
+
+func TestClient_Query_TXT(t *testing.T) {
+	conn := newMemConn(zoneResponder(&txtOnlyZone{Zone: makeServiceWithServiceName(t, "_txt._tcp")}))
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_txt._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no complete entries, got %d", len(entries))
+	}
+
+	params.QueryType = dns.TypeTXT
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	e := <-entries
+	if e.Name != "hostname._txt._tcp.local." || e.Port != 0 || e.AddrV4 != nil {
+		t.Fatalf("bad: %v", e)
+	}
+	if len(e.InfoFields) != 1 || e.InfoFields[0] != "Local web server" {
+		t.Fatalf("bad info: %v", e.InfoFields)
+	}
+
+	params.QueryType = dns.TypeSRV
+	if err := c.Query(params); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an unsupported query type, got: %v", err)
+	}
+}
+
+func TestClient_Query_QueryTypes(t *testing.T) {
+	respond := zoneResponder(makeServiceWithServiceName(t, "_types._tcp"))
+	var lock sync.Mutex
+	var asked []uint16
+	conn := newMemConn(func(b []byte) []byte {
+		var query dns.Msg
+		lock.Lock()
+		if err := query.Unpack(b); err == nil && len(asked) == 0 {
+			for _, q := range query.Question {
+				asked = append(asked, q.Qtype)
+			}
+		}
+		lock.Unlock()
+		return respond(b)
+	})
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_types._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+		QueryTypes:  []uint16{dns.TypePTR, dns.TypeSRV, dns.TypeTXT},
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(asked, params.QueryTypes) {
+		t.Fatalf("expected a question per type, got %v", asked)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	// The address records weren't asked for, but are still used to
+	// complete the entry
+	if e := <-entries; !e.AddrV4.Equal(net.IPv4(192, 168, 0, 42)) || e.AddrV6 == nil || e.Port != 80 {
+		t.Fatalf("bad: %v", e)
+	}
+
+	params.QueryTypes = []uint16{dns.TypePTR, 0}
+	if err := c.Query(params); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for a zero query type, got: %v", err)
+	}
+}
+
+func TestClient_Query_DrainAfterLastResponse(t *testing.T) {
+	// Answer with the pointer and TXT records before the timeout, and the
+	// rest of the records only after it
+	full := zoneResponder(makeServiceWithServiceName(t, "_late._tcp"))
+	var conn *memConn
+	conn = newMemConn(func(b []byte) []byte {
+		out := full(b)
+		if out == nil {
+			return nil
+		}
+		var resp dns.Msg
+		if err := resp.Unpack(out); err != nil {
+			return nil
+		}
+		early, late := resp.Copy(), resp.Copy()
+		early.Answer, late.Answer = nil, nil
+		for _, rr := range resp.Answer {
+			switch rr.Header().Rrtype {
+			case dns.TypePTR, dns.TypeTXT:
+				early.Answer = append(early.Answer, rr)
+			default:
+				late.Answer = append(late.Answer, rr)
+			}
+		}
+		for _, r := range []struct {
+			msg   *dns.Msg
+			delay time.Duration
+		}{{early, 50 * time.Millisecond}, {late, 150 * time.Millisecond}} {
+			buf, err := r.msg.Pack()
+			if err != nil {
+				t.Errorf("err: %v", err)
+				continue
+			}
+			time.AfterFunc(r.delay, func() { conn.in <- buf })
+		}
+		return nil
+	})
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_late._tcp",
+		Domain:      "local",
+		Timeout:     100 * time.Millisecond,
+		Entries:     entries,
+		DisableIPv6: true,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the late records to be missed, got %d entries", len(entries))
+	}
+
+	// Discard the records that arrived too late
+	time.Sleep(200 * time.Millisecond)
+	for len(conn.in) > 0 {
+		<-conn.in
+	}
+
+	params.DrainAfterLastResponse = 200 * time.Millisecond
+	params.MaxTimeout = time.Second
+	start := time.Now()
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if e := <-entries; e.Name != "hostname._late._tcp.local." || e.Port != 80 {
+		t.Fatalf("bad: %v", e)
+	}
+	if d := time.Since(start); d >= params.MaxTimeout {
+		t.Fatalf("query took %v", d)
+	}
+}
+
+func TestClient_Query_DrainAfterLastResponse_Unrelated(t *testing.T) {
+	// Other services keep announcing new instances on the group
+	q := new(dns.Msg)
+	q.SetQuestion("_chatty._tcp.local.", dns.TypePTR)
+	buf, err := q.Pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var announcements [][]byte
+	for i := 0; i < 100; i++ {
+		s, err := NewMDNSService(fmt.Sprintf("host%d", i), "_chatty._tcp", "local.", fmt.Sprintf("host%d.", i),
+			80, []net.IP{net.IPv4(192, 168, 0, byte(i))}, []string{"chatty"})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		announcements = append(announcements, zoneResponder(s)(buf))
+	}
+	conn := newMemConn(func([]byte) []byte { return nil })
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for _, announce := range announcements {
+			select {
+			case <-ticker.C:
+				select {
+				case conn.in <- announce:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	params := &QueryParam{
+		Service:                "_quiet._tcp",
+		Domain:                 "local",
+		Timeout:                100 * time.Millisecond,
+		Entries:                make(chan *ServiceEntry, 4),
+		DisableIPv6:            true,
+		DrainAfterLastResponse: 200 * time.Millisecond,
+		MaxTimeout:             2 * time.Second,
+	}
+	start := time.Now()
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("expected unrelated responses not to extend the query, took %v", d)
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	now := time.Now()
+	end, limit := now.Add(time.Second), now.Add(3*time.Second)
+	if d := drainDeadline(end, limit, now.Add(2*time.Second)); !d.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("bad: %v", d.Sub(now))
+	}
+	if d := drainDeadline(end, limit, now.Add(500*time.Millisecond)); !d.Equal(end) {
+		t.Fatalf("expected the window not to shrink: %v", d.Sub(now))
+	}
+	if d := drainDeadline(end, limit, now.Add(5*time.Second)); !d.Equal(limit) {
+		t.Fatalf("expected the limit: %v", d.Sub(now))
+	}
+}
+
+// addrOnRequestZone only answers with address records when asked for them
+type addrOnRequestZone struct {
+	Zone
+}
+
+func (z *addrOnRequestZone) Records(q dns.Question) []dns.RR {
+	recs := z.Zone.Records(q)
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		return recs
+	}
+	var out []dns.RR
+	for _, rr := range recs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+		default:
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func TestClient_Query_AsksHostAddresses(t *testing.T) {
+	conn := newMemConn(zoneResponder(&addrOnRequestZone{Zone: makeServiceWithServiceName(t, "_noaddr._tcp")}))
+	c := newClientWithPacketConns(conn, nil)
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:         "_noaddr._tcp",
+		Domain:          "local",
+		Timeout:         time.Second,
+		Entries:         entries,
+		ResolveInstance: "hostname",
+		DisableIPv6:     true,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-entries:
+		if !e.AddrV4.Equal(net.IPv4(192, 168, 0, 42)) || e.Port != 80 {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("expected the host's addresses to be asked for")
+	}
+}
+
+// errNetworkDown is the error writes to a failingConn fail with
+var errNetworkDown = errors.New("network is down")
+
+// failingConn is a listener whose writes fail
+type failingConn struct {
+	*memConn
+}
+
+func (failingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Err: errNetworkDown}
+}
+
+func TestClient_SendQuery_FailedFamilies(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("_send._tcp.local.", dns.TypePTR)
+
+	// The query is still sent over the family that works
+	var buf bytes.Buffer
+	stats := &Stats{}
+	params := &QueryParam{Stats: stats}
+	c := newClientWithPacketConns(failingConn{newMemConn(nil)}, newMemConn(func([]byte) []byte { return nil }))
+	c.logger = log.New(&buf, "", 0)
+	defer c.Close()
+	if err := c.sendQuery(m, params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.SendFailures != 1 || stats.QueriesSentV6 != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	if !strings.Contains(buf.String(), "udp4") {
+		t.Fatalf("expected the failed family to be logged: %q", buf.String())
+	}
+
+	// Only failing over every family is an error
+	c2 := newClientWithPacketConns(failingConn{newMemConn(nil)}, failingConn{newMemConn(nil)})
+	defer c2.Close()
+	err := c2.sendQuery(m, params)
+	var sendErrs SendErrors
+	if !errors.As(err, &sendErrs) || len(sendErrs) != 2 || sendErrs[0].Network != "udp4" || sendErrs[1].Network != "udp6" {
+		t.Fatalf("expected send errors for both families, got: %v", err)
+	}
+	if !errors.Is(err, errNetworkDown) {
+		t.Fatalf("expected the causes to be unwrapped: %v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "write" {
+		t.Fatalf("expected the write error, got: %v", opErr)
+	}
+	for _, cause := range sendErrs.Unwrap() {
+		if !errors.Is(cause, errNetworkDown) {
+			t.Fatalf("bad cause: %v", cause)
+		}
+	}
+
+	// There is nothing to send over with both families disabled
+	if err := c.sendQuery(m, &QueryParam{DisableIPv4: true, DisableIPv6: true}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam, got: %v", err)
+	}
+}
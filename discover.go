@@ -0,0 +1,79 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DiscoveredEntry is a service entry found by Discover, along with the type
+// of service it was found for
+type DiscoveredEntry struct {
+	ServiceType string // Type of the service, such as "_http._tcp"
+	Entry       *ServiceEntry
+}
+
+// Discover finds every service advertised in the "local" domain. It first
+// lists the types of service advertised, then queries for each type at
+// once, streaming the entries found to a channel. Each step waits at most
+// for the timeout. Sends will not block, so clients should make sure to
+// either read or buffer.
+func Discover(ctx context.Context, timeout time.Duration, entries chan<- *DiscoveredEntry) error {
+	params := &QueryParam{
+		Domain:  "local",
+		Timeout: timeout,
+	}
+	client, err := newClient(params)
+	if err != nil {
+		return err
+	}
+	types, err := client.listServiceTypes(ctx, params)
+	client.Close()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(types))
+	for _, service := range types {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			if err := discoverType(ctx, service, timeout, entries); err != nil {
+				errCh <- fmt.Errorf("failed to query %s: %w", service, err)
+			}
+		}(service)
+	}
+	wg.Wait()
+	close(errCh)
+
+	// Report the first failure, as the other types were still queried
+	return <-errCh
+}
+
+// discoverType queries for a single type of service, tagging the entries
+// found with the type
+func discoverType(ctx context.Context, service string, timeout time.Duration, entries chan<- *DiscoveredEntry) error {
+	entriesCh := make(chan *ServiceEntry, 16)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for e := range entriesCh {
+			select {
+			case entries <- &DiscoveredEntry{ServiceType: service, Entry: e}:
+			default:
+			}
+		}
+	}()
+
+	err := QueryContext(ctx, &QueryParam{
+		Service: service,
+		Domain:  "local",
+		Timeout: timeout,
+		Entries: entriesCh,
+	})
+	close(entriesCh)
+	<-doneCh
+	return err
+}
@@ -0,0 +1,38 @@
+package mdns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_discover._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *DiscoveredEntry, 16)
+	if err := Discover(context.Background(), 50*time.Millisecond, entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	found := false
+	for len(entries) > 0 {
+		d := <-entries
+		if d.ServiceType != "_discover._tcp" {
+			continue
+		}
+		if d.Entry.Name != "hostname._discover._tcp.local." {
+			t.Fatalf("bad: %v", d.Entry)
+		}
+		if d.Entry.ServiceType != d.ServiceType || d.Entry.Domain != "local" {
+			t.Fatalf("bad service type: %q in %q", d.Entry.ServiceType, d.Entry.Domain)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("record not found")
+	}
+}
@@ -3,6 +3,7 @@ module github.com/hashicorp/mdns
 require (
 	github.com/miekg/dns v1.1.41
 	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1
+	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44
 )
 
-go 1.13
+go 1.16
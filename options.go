@@ -0,0 +1,122 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// QueryOption configures the parameters built by NewQuery
+type QueryOption func(*QueryParam)
+
+// NewQuery returns the parameters to look up a service, starting from
+// DefaultParams and applying the options in order. An error is returned if
+// the resulting parameters are invalid, such as the service name not being
+// a valid domain name.
+func NewQuery(service string, opts ...QueryOption) (*QueryParam, error) {
+	params := DefaultParams(service)
+	for _, opt := range opts {
+		opt(params)
+	}
+
+	if _, err := queryServices(params); err != nil {
+		return nil, err
+	}
+	if params.Timeout <= 0 {
+		return nil, fmt.Errorf("%w: timeout must be positive: %v", ErrInvalidParam, params.Timeout)
+	}
+	if params.Entries == nil {
+		return nil, ErrNoEntriesChannel
+	}
+	return params, nil
+}
+
+// WithTimeout sets how long the query waits for responses
+func WithTimeout(timeout time.Duration) QueryOption {
+	return func(p *QueryParam) {
+		p.Timeout = timeout
+	}
+}
+
+// WithInitialDelay sets the longest random delay before the query is first
+// sent, which may be zero to send it immediately
+func WithInitialDelay(delay time.Duration) QueryOption {
+	return func(p *QueryParam) {
+		p.InitialDelay = delay
+	}
+}
+
+// WithDomain sets the domain the service is looked up in
+func WithDomain(domain string) QueryOption {
+	return func(p *QueryParam) {
+		p.Domain = domain
+	}
+}
+
+// WithInterface sets the multicast interface to query on
+func WithInterface(iface *net.Interface) QueryOption {
+	return func(p *QueryParam) {
+		p.Interface = iface
+	}
+}
+
+// WithEntries sets the channel the entries found are streamed to
+func WithEntries(entries chan<- *ServiceEntry) QueryOption {
+	return func(p *QueryParam) {
+		p.Entries = entries
+	}
+}
+
+// WithUnicast asks responders to reply directly to the client, as per
+// section 5.4 of RFC 6762
+func WithUnicast() QueryOption {
+	return func(p *QueryParam) {
+		p.WantUnicastResponse = true
+	}
+}
+
+// WithRetries sets the number of times the query is sent within the timeout
+func WithRetries(retries int) QueryOption {
+	return func(p *QueryParam) {
+		p.Retries = retries
+	}
+}
+
+// WithDrainAfterLastResponse keeps a query listening for the grace period
+// after each response, past its timeout, for up to max in total
+func WithDrainAfterLastResponse(grace, max time.Duration) QueryOption {
+	return func(p *QueryParam) {
+		p.DrainAfterLastResponse = grace
+		p.MaxTimeout = max
+	}
+}
+
+// WithListenConfig binds the listeners of the query's client with the
+// config, such as to set socket options in its Control
+func WithListenConfig(lc *net.ListenConfig) QueryOption {
+	return func(p *QueryParam) {
+		p.ListenConfig = lc
+	}
+}
+
+// WithQueryType sets the records the query is for, dns.TypeTXT streaming
+// entries as soon as their TXT records arrive
+func WithQueryType(qtype uint16) QueryOption {
+	return func(p *QueryParam) {
+		p.QueryType = qtype
+	}
+}
+
+// WithQueryClass sets the class of the questions asked
+func WithQueryClass(class uint16) QueryOption {
+	return func(p *QueryParam) {
+		p.QueryClass = class
+	}
+}
+
+// WithSubtype narrows the lookup to instances of a subtype of the service
+func WithSubtype(subtype string) QueryOption {
+	return func(p *QueryParam) {
+		p.Subtype = subtype
+	}
+}
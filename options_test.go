@@ -0,0 +1,56 @@
+package mdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewQuery(t *testing.T) {
+	entries := make(chan *ServiceEntry, 1)
+	params, err := NewQuery("_http._tcp",
+		WithTimeout(50*time.Millisecond),
+		WithDomain("example"),
+		WithEntries(entries),
+		WithUnicast(),
+		WithRetries(3),
+		WithQueryClass(dns.ClassCHAOS),
+		WithSubtype("_printer"),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if params.Service != "_http._tcp" || params.Domain != "example" || params.Timeout != 50*time.Millisecond {
+		t.Fatalf("bad: %#v", params)
+	}
+	if params.Entries != entries || !params.WantUnicastResponse || params.Retries != 3 ||
+		params.QueryClass != dns.ClassCHAOS || params.Subtype != "_printer" {
+		t.Fatalf("bad: %#v", params)
+	}
+
+	// The defaults are used without options
+	params, err = NewQuery("_http._tcp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if params.Domain != "local" || params.Timeout != time.Second || params.Entries == nil {
+		t.Fatalf("bad defaults: %#v", params)
+	}
+	if cap(params.Entries) != defaultEntriesBuffer {
+		t.Fatalf("expected the default entries channel to be buffered, got capacity %d", cap(params.Entries))
+	}
+}
+
+func TestNewQuery_Invalid(t *testing.T) {
+	if _, err := NewQuery("_http.._tcp"); !errors.Is(err, ErrInvalidServiceName) {
+		t.Fatalf("expected ErrInvalidServiceName, got: %v", err)
+	}
+	if _, err := NewQuery("_http._tcp", WithTimeout(0)); err == nil {
+		t.Fatalf("expected an error for a zero timeout")
+	}
+	if _, err := NewQuery("_http._tcp", WithEntries(nil)); err != ErrNoEntriesChannel {
+		t.Fatalf("expected ErrNoEntriesChannel, got: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package mdns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// Responder answers queries from a Zone like a Server, however it uses a
+// single listener that doesn't need to join a multicast group, and sends no
+// announcements or goodbyes. It is intended for testing code that queries:
+// paired with a client created by NewClientWithConns on loopback, queries
+// sent with QueryParam.UnicastAddr set to Addr run without touching the
+// network.
+type Responder struct {
+	server *Server
+	conn   *net.UDPConn
+}
+
+// NewResponder starts answering the queries received on conn with records
+// from the zone. The responder takes ownership of the listener, closing it
+// on Close.
+func NewResponder(conn *net.UDPConn, zone Zone) (*Responder, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("%w: a listener must be provided", ErrInvalidParam)
+	}
+	if zone == nil {
+		return nil, fmt.Errorf("%w: a Zone must be provided", ErrInvalidParam)
+	}
+
+	s := &Server{
+		config: &Config{
+			Zone:   zone,
+			Logger: log.Default(),
+		},
+		shutdownCh: make(chan struct{}),
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		s.ipv4List = conn
+	} else {
+		s.ipv6List = conn
+	}
+	go s.recv(conn)
+
+	return &Responder{server: s, conn: conn}, nil
+}
+
+// Addr returns the address queries should be sent to
+func (r *Responder) Addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the responder and closes its listener
+func (r *Responder) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.server.shutdown, 0, 1) {
+		return nil
+	}
+	close(r.server.shutdownCh)
+	return r.conn.Close()
+}
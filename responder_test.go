@@ -0,0 +1,222 @@
+package mdns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponder(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r, err := NewResponder(conn, makeServiceWithServiceName(t, "_fake._tcp"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	// Query from a client that only uses loopback
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(l, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:     "_fake._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     entries,
+		UnicastAddr: r.Addr(),
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if e := <-entries; e.Name != "hostname._fake._tcp.local." || e.Port != 80 {
+		t.Fatalf("bad: %v", e)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries once the responder is closed, got %d", len(entries))
+	}
+}
+
+func TestResponder_NilArgs(t *testing.T) {
+	if _, err := NewResponder(nil, makeService(t)); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected invalid parameter error for missing listener, got %v", err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := NewResponder(conn, nil); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected invalid parameter error for missing zone, got %v", err)
+	}
+}
+
+func TestResponder_Stats(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r, err := NewResponder(conn, makeServiceWithServiceName(t, "_stats._tcp"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(l, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Send the client a packet that isn't DNS, once it is listening
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		junk, err := net.DialUDP("udp4", nil, l.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			return
+		}
+		defer junk.Close()
+		junk.Write([]byte("junk"))
+	}()
+
+	stats := new(Stats)
+	params := &QueryParam{
+		Service:     "_stats._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     make(chan *ServiceEntry, 4),
+		UnicastAddr: r.Addr(),
+		Stats:       stats,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if stats.QueriesSentV4 != 1 || stats.QueriesSentV6 != 0 || stats.BytesSent == 0 {
+		t.Fatalf("bad sent stats: %+v", stats)
+	}
+	if stats.PacketsReceived != 2 || stats.ParseFailures != 1 {
+		t.Fatalf("bad received stats: %+v", stats)
+	}
+
+	// The pointer, service, both addresses and text of the instance
+	if stats.RecordsMatched != 5 {
+		t.Fatalf("bad matched stats: %+v", stats)
+	}
+}
+
+func TestResponder_OnPacket(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r, err := NewResponder(conn, makeServiceWithServiceName(t, "_onpacket._tcp"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(l, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	var lock sync.Mutex
+	var sizes []int
+	var errs []error
+	params := &QueryParam{
+		Service:     "_onpacket._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     make(chan *ServiceEntry, 4),
+		UnicastAddr: r.Addr(),
+		OnPacket: func(src net.Addr, data []byte, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if src.String() != r.Addr().String() {
+				t.Errorf("unexpected source %v", src)
+			}
+			sizes = append(sizes, len(data))
+			errs = append(errs, err)
+		},
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sizes) != 1 || sizes[0] == 0 || errs[0] != nil {
+		t.Fatalf("expected a single response, got sizes %v and errors %v", sizes, errs)
+	}
+}
+
+func TestResponder_EntriesDropped(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r, err := NewResponder(conn, makeServiceWithServiceName(t, "_dropped._tcp"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c, err := NewClientWithConns(l, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	// Nobody reads the unbuffered channel, so the entry can't be sent
+	stats := new(Stats)
+	params := &QueryParam{
+		Service:     "_dropped._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     make(chan *ServiceEntry),
+		UnicastAddr: r.Addr(),
+		Stats:       stats,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.EntriesDropped != 1 {
+		t.Fatalf("expected 1 dropped entry, got %d", stats.EntriesDropped)
+	}
+}
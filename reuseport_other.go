@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mdns
+
+import (
+	"syscall"
+)
+
+// reusePortControl is a no-op on platforms without SO_REUSEPORT, where the
+// bind behaves as it would with net.ListenMulticastUDP.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -5,9 +5,13 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -15,6 +19,20 @@ const (
 	ipv6mdns              = "ff02::fb"
 	mdnsPort              = 5353
 	forceUnicastResponses = false
+
+	// probeCount and probeInterval are the number of probe queries sent
+	// for an instance name, and the time between them, per section 8.1
+	// of RFC 6762
+	probeCount    = 3
+	probeInterval = 250 * time.Millisecond
+
+	// probeMaxDelay bounds the random delay before the first probe, so
+	// that hosts starting together don't probe in lockstep
+	probeMaxDelay = 250 * time.Millisecond
+
+	// maxProbeRenames bounds how many alternative instance names are
+	// tried after conflicts
+	maxProbeRenames = 16
 )
 
 var (
@@ -41,6 +59,31 @@ type Config struct {
 	// LogEmptyResponses indicates the server should print an informative message
 	// when there is an mDNS query for which the server has no response.
 	LogEmptyResponses bool
+
+	// IPs optionally overrides the addresses answered for the Zone's A and
+	// AAAA records, such as to advertise every address of a host with
+	// several interfaces. InterfaceIPs returns the addresses of an
+	// interface.
+	//
+	// If Iface is provided, link-local addresses that don't belong to it are
+	// never advertised, as they can't be reached from its link.
+	IPs []net.IP
+
+	// Logger can optionally be set to use an alternative logger instead of the
+	// default.
+	Logger *log.Logger
+
+	// IPv4Group and IPv6Group optionally override the multicast group and
+	// port listened on, which default to 224.0.0.251:5353 and
+	// [ff02::fb]:5353.
+	IPv4Group *net.UDPAddr
+	IPv6Group *net.UDPAddr
+
+	// Probe indicates the server should check that the instance name is not
+	// already in use before responding to queries. On a conflict the Zone is
+	// renamed, appending " (2)", " (3)", etc. to the instance name, and the
+	// chosen name can be read back from the Zone.
+	Probe bool
 }
 
 // mDNS server is used to listen for mDNS queries and respond if we
@@ -51,28 +94,60 @@ type Server struct {
 	ipv4List *net.UDPConn
 	ipv6List *net.UDPConn
 
+	// ifaceIPs are the addresses of the configured interface
+	ifaceIPs []net.IP
+
 	shutdown   int32
 	shutdownCh chan struct{}
 }
 
 // NewServer is used to create a new mDNS server from a config
 func NewServer(config *Config) (*Server, error) {
+	if config.Zone == nil {
+		return nil, fmt.Errorf("%w: a Zone must be provided", ErrInvalidParam)
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+	if config.IPv4Group == nil {
+		config.IPv4Group = ipv4Addr
+	}
+	if config.IPv6Group == nil {
+		config.IPv6Group = ipv6Addr
+	}
+
+	var ifaceIPs []net.IP
+	if config.Iface != nil {
+		var err error
+		if ifaceIPs, err = InterfaceIPs(config.Iface); err != nil {
+			return nil, fmt.Errorf("mdns: failed to get the addresses of %s: %v", config.Iface.Name, err)
+		}
+	}
+
 	// Create the listeners
-	ipv4List, _ := net.ListenMulticastUDP("udp4", config.Iface, ipv4Addr)
-	ipv6List, _ := net.ListenMulticastUDP("udp6", config.Iface, ipv6Addr)
+	ipv4List, _ := net.ListenMulticastUDP("udp4", config.Iface, config.IPv4Group)
+	ipv6List, _ := net.ListenMulticastUDP("udp6", config.Iface, config.IPv6Group)
 
 	// Check if we have any listener
 	if ipv4List == nil && ipv6List == nil {
-		return nil, fmt.Errorf("No multicast listeners could be started")
+		return nil, fmt.Errorf("%w: no multicast listeners could be started", ErrBindFailed)
 	}
 
 	s := &Server{
 		config:     config,
 		ipv4List:   ipv4List,
 		ipv6List:   ipv6List,
+		ifaceIPs:   ifaceIPs,
 		shutdownCh: make(chan struct{}),
 	}
 
+	if config.Probe {
+		if err := s.probe(); err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+
 	if ipv4List != nil {
 		go s.recv(s.ipv4List)
 	}
@@ -93,13 +168,263 @@ func (s *Server) Shutdown() error {
 
 	close(s.shutdownCh)
 
+	// Let browsers know the records are going away rather than leaving
+	// them to expire
+	s.sendGoodbye()
+
+	s.closeListeners()
+	return nil
+}
+
+// closeListeners closes the multicast listeners
+func (s *Server) closeListeners() {
 	if s.ipv4List != nil {
 		s.ipv4List.Close()
 	}
 	if s.ipv6List != nil {
 		s.ipv6List.Close()
 	}
-	return nil
+}
+
+// prober is implemented by a Zone with an instance name that must be
+// unique, so it can be probed for and renamed on conflict
+type prober interface {
+	announcer
+	instance() string
+	probeName() string
+	rename(instance string) error
+}
+
+// probe checks the zone's instance name is not in use, as described in
+// section 8 of RFC 6762, renaming it until a free name is found. The first
+// probe is sent after a random delay of up to 250ms, per section 8.1.
+//
+// Simultaneous probe tiebreaking, per section 8.2, is not handled: the
+// server doesn't receive queries until probing is done, so a host probing
+// for the same name at the same time isn't seen, and both may claim it.
+func (s *Server) probe() error {
+	p, ok := s.config.Zone.(prober)
+	if !ok {
+		return nil
+	}
+	time.Sleep(time.Duration(newRand().Int63n(int64(probeMaxDelay))))
+
+	base := p.instance()
+	for attempt := 1; attempt <= maxProbeRenames; attempt++ {
+		if attempt > 1 {
+			if err := p.rename(fmt.Sprintf("%s (%d)", base, attempt)); err != nil {
+				return err
+			}
+		}
+		conflict, err := s.probeConflict(p)
+		if err != nil {
+			return err
+		}
+		if !conflict {
+			return nil
+		}
+		s.config.Logger.Printf("[INFO] mdns: Instance name %q is in use", p.instance())
+	}
+	return fmt.Errorf("mdns: could not find a free instance name for %q", base)
+}
+
+// probeConflict sends probe queries for the zone's instance name and
+// reports whether another responder answered for it
+func (s *Server) probeConflict(p prober) (bool, error) {
+	name := p.probeName()
+
+	// Open a socket for each family we listen on, so that unicast
+	// answers to the probes can be received
+	var conns []*net.UDPConn
+	if s.ipv4List != nil {
+		if conn, err := s.listenEphemeral("udp4", &net.UDPAddr{IP: net.IPv4zero}); err == nil {
+			conns = append(conns, conn)
+		}
+	}
+	if s.ipv6List != nil {
+		if conn, err := s.listenEphemeral("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err == nil {
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		return false, fmt.Errorf("%w: no sockets could be opened to probe", ErrBindFailed)
+	}
+
+	// The probe asks for any record of the name, and carries the records
+	// we intend to use in the authority section
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeANY)
+	q.Question[0].Qclass |= 1 << 15
+	q.RecursionDesired = false
+	for _, rr := range p.announcement() {
+		if rr.Header().Name == name {
+			q.Ns = append(q.Ns, rr)
+		}
+	}
+	buf, err := q.Pack()
+	if err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false, err
+	}
+
+	conflictCh := make(chan struct{}, len(conns))
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			if probeAnswered(conn, name) {
+				conflictCh <- struct{}{}
+			}
+		}(conn)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		wg.Wait()
+	}()
+
+	for i := 0; i < probeCount; i++ {
+		for _, conn := range conns {
+			gaddr := s.config.IPv4Group
+			if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+				gaddr = s.config.IPv6Group
+			}
+			if _, err := conn.WriteToUDP(buf, gaddr); err != nil {
+				s.config.Logger.Printf("[ERR] mdns: Failed to send probe: %v", err)
+			}
+		}
+
+		select {
+		case <-conflictCh:
+			return true, nil
+		case <-time.After(probeInterval):
+		}
+	}
+	return false, nil
+}
+
+// listenEphemeral opens a socket on an ephemeral port to send multicast
+// packets from
+func (s *Server) listenEphemeral(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := setMulticastInterface(network, conn, s.config.Iface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// probeAnswered reads responses from conn until it is closed, and reports
+// whether any of them had a record for name
+func probeAnswered(conn *net.UDPConn, name string) bool {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		for _, rr := range responseRecords(&msg) {
+			if strings.EqualFold(rr.Header().Name, name) {
+				return true
+			}
+		}
+	}
+}
+
+// announcer is implemented by a Zone that can list the records it
+// advertises, so they can be sent without a matching question
+type announcer interface {
+	announcement() []dns.RR
+}
+
+// goodbyeRecords returns the records the server advertises, with the
+// addresses it answers with in place of the zone's, and a zero TTL
+func (s *Server) goodbyeRecords() []dns.RR {
+	a, ok := s.config.Zone.(announcer)
+	if !ok {
+		return nil
+	}
+	recs := s.addressRecords(a.announcement())
+	for i, rr := range recs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		recs[i] = rr
+	}
+	return recs
+}
+
+// sendGoodbye multicasts the zone's records with a zero TTL, as described
+// in section 10.1 of RFC 6762, so browsers remove them immediately
+func (s *Server) sendGoodbye() {
+	recs := s.goodbyeRecords()
+	if len(recs) == 0 {
+		return
+	}
+	resp := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response:      true,
+			Opcode:        dns.OpcodeQuery,
+			Authoritative: true,
+		},
+		Compress: true,
+		Answer:   recs,
+	}
+	buf, err := resp.Pack()
+	if err != nil {
+		s.config.Logger.Printf("[ERR] mdns: Failed to pack goodbye: %v", err)
+		return
+	}
+	if s.ipv4List != nil {
+		if err := s.sendMulticast("udp4", s.config.IPv4Group, buf); err != nil {
+			s.config.Logger.Printf("[ERR] mdns: Failed to send goodbye: %v", err)
+		}
+	}
+	if s.ipv6List != nil {
+		if err := s.sendMulticast("udp6", s.config.IPv6Group, buf); err != nil {
+			s.config.Logger.Printf("[ERR] mdns: Failed to send goodbye: %v", err)
+		}
+	}
+}
+
+// sendMulticast sends a packet to the multicast group. The listeners are
+// bound to the group address, so packets sent from them would carry it as
+// their source, which receivers drop. A separate socket is used instead.
+func (s *Server) sendMulticast(network string, gaddr *net.UDPAddr, buf []byte) error {
+	laddr := &net.UDPAddr{IP: net.IPv4zero}
+	if network == "udp6" {
+		laddr = &net.UDPAddr{IP: net.IPv6unspecified}
+	}
+	conn, err := s.listenEphemeral(network, laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteToUDP(buf, gaddr)
+	return err
+}
+
+// setMulticastInterface sets the interface used to send multicast packets
+// from conn, if one is given
+func setMulticastInterface(network string, conn *net.UDPConn, iface *net.Interface) error {
+	if iface == nil {
+		return nil
+	}
+	if network == "udp4" {
+		return ipv4.NewPacketConn(conn).SetMulticastInterface(iface)
+	}
+	return ipv6.NewPacketConn(conn).SetMulticastInterface(iface)
 }
 
 // recv is a long running routine to receive packets from an interface
@@ -115,7 +440,7 @@ func (s *Server) recv(c *net.UDPConn) {
 			continue
 		}
 		if err := s.parsePacket(buf[:n], from); err != nil {
-			log.Printf("[ERR] mdns: Failed to handle query: %v", err)
+			s.config.Logger.Printf("[ERR] mdns: Failed to handle query: %v", err)
 		}
 	}
 }
@@ -124,7 +449,7 @@ func (s *Server) recv(c *net.UDPConn) {
 func (s *Server) parsePacket(packet []byte, from net.Addr) error {
 	var msg dns.Msg
 	if err := msg.Unpack(packet); err != nil {
-		log.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
+		s.config.Logger.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
 		return err
 	}
 	return s.handleQuery(&msg, from)
@@ -223,7 +548,7 @@ func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
 		for i, q := range query.Question {
 			questions[i] = q.Name
 		}
-		log.Printf("no responses for query with questions: %s", strings.Join(questions, ", "))
+		s.config.Logger.Printf("[INFO] mdns: no responses for query with questions: %s", strings.Join(questions, ", "))
 	}
 
 	if mresp := resp(false); mresp != nil {
@@ -244,7 +569,7 @@ func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
 // The response to a question may be transmitted over multicast, unicast, or
 // both.  The return values are DNS records for each transmission type.
 func (s *Server) handleQuestion(q dns.Question) (multicastRecs, unicastRecs []dns.RR) {
-	records := s.config.Zone.Records(q)
+	records := s.addressRecords(s.config.Zone.Records(q))
 
 	if len(records) == 0 {
 		return nil, nil
@@ -267,6 +592,103 @@ func (s *Server) handleQuestion(q dns.Question) (multicastRecs, unicastRecs []dn
 	return records, nil
 }
 
+// InterfaceIPs returns the unicast addresses assigned to an interface, for
+// advertising every address of a host
+func InterfaceIPs(iface *net.Interface) ([]net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// addressRecords replaces the addresses of the A and AAAA records with the
+// configured IPs, if any, and drops the link-local addresses that don't
+// belong to the configured interface
+func (s *Server) addressRecords(records []dns.RR) []dns.RR {
+	if len(s.config.IPs) == 0 && s.config.Iface == nil {
+		return records
+	}
+
+	var out []dns.RR
+	replaced := make(map[rrset]struct{})
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+			out = append(out, rr)
+			continue
+		}
+
+		if len(s.config.IPs) == 0 {
+			if s.advertised(addressOf(rr)) {
+				out = append(out, rr)
+			}
+			continue
+		}
+
+		// Answer every configured address in place of the first record of
+		// each name and type
+		key := rrset{hdr.Name, hdr.Rrtype}
+		if _, ok := replaced[key]; ok {
+			continue
+		}
+		replaced[key] = struct{}{}
+		for _, ip := range s.config.IPs {
+			if !s.advertised(ip) {
+				continue
+			}
+			if rec := addressRecord(*hdr, ip); rec != nil {
+				out = append(out, rec)
+			}
+		}
+	}
+	return out
+}
+
+// advertised checks if an address may be advertised, which link-local
+// addresses may only be on the interface they belong to
+func (s *Server) advertised(ip net.IP) bool {
+	if s.config.Iface == nil || !ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, own := range s.ifaceIPs {
+		if own.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressOf returns the address of an A or AAAA record
+func addressOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// addressRecord returns a record with the header for the address, or nil
+// if the address is of the other family
+func addressRecord(hdr dns.RR_Header, ip net.IP) dns.RR {
+	ip4 := ip.To4()
+	switch {
+	case hdr.Rrtype == dns.TypeA && ip4 != nil:
+		return &dns.A{Hdr: hdr, A: ip4}
+	case hdr.Rrtype == dns.TypeAAAA && ip4 == nil && ip.To16() != nil:
+		return &dns.AAAA{Hdr: hdr, AAAA: ip.To16()}
+	}
+	return nil
+}
+
 // sendResponse is used to send a response packet
 func (s *Server) sendResponse(resp *dns.Msg, from net.Addr, unicast bool) error {
 	// TODO(reddaly): Respect the unicast argument, and allow sending responses
@@ -1,9 +1,13 @@
 package mdns
 
 import (
-	"sync/atomic"
+	"errors"
+	"net"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestServer_StartStop(t *testing.T) {
@@ -15,34 +19,90 @@ func TestServer_StartStop(t *testing.T) {
 	defer serv.Shutdown()
 }
 
-func TestServer_Lookup(t *testing.T) {
-	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_foobar._tcp")})
+func TestServer_NilZone(t *testing.T) {
+	if _, err := NewServer(&Config{}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected invalid parameter error for missing zone, got %v", err)
+	}
+}
+
+func TestServer_Probe(t *testing.T) {
+	existing, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_probe._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer existing.Shutdown()
+
+	zone := makeServiceWithServiceName(t, "_probe._tcp")
+	serv, err := NewServer(&Config{Zone: zone, Probe: true})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer serv.Shutdown()
 
-	entries := make(chan *ServiceEntry, 1)
-	var found int32 = 0
-	go func() {
-		select {
-		case e := <-entries:
-			if e.Name != "hostname._foobar._tcp.local." {
-				t.Fatalf("bad: %v", e)
-			}
-			if e.Port != 80 {
-				t.Fatalf("bad: %v", e)
-			}
-			if e.Info != "Local web server" {
-				t.Fatalf("bad: %v", e)
-			}
-			atomic.StoreInt32(&found, 1)
+	if zone.Instance != "hostname (2)" {
+		t.Fatalf("expected the instance to be renamed, got %q", zone.Instance)
+	}
+
+	// The renamed instance should answer for its new name
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_probe._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	names := make(map[string]bool)
+	for len(entries) > 0 {
+		names[(<-entries).Name] = true
+	}
+	if !names[`hostname\ \(2\)._probe._tcp.local.`] {
+		t.Fatalf("renamed instance not found: %v", names)
+	}
+}
+
+func TestServer_EscapedInstance(t *testing.T) {
+	zone, err := NewMDNSService("Bob's Printer.local", "_escaped._tcp", "local.", "testhost.", 80,
+		[]net.IP{net.IP([]byte{127, 0, 0, 1})}, []string{"Local web server"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
 
-		case <-time.After(80 * time.Millisecond):
-			t.Fatalf("timeout")
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_escaped._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Name != `Bob\'s\ Printer\.local._escaped._tcp.local.` {
+			t.Fatalf("bad: %v", e.Name)
 		}
-	}()
+	default:
+		t.Fatalf("record not found")
+	}
+}
 
+func TestServer_Lookup(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_foobar._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 1)
 	params := &QueryParam{
 		Service: "_foobar._tcp",
 		Domain:  "local",
@@ -53,7 +113,411 @@ func TestServer_Lookup(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if atomic.LoadInt32(&found) == 0 {
+
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._foobar._tcp.local." {
+			t.Fatalf("bad: %v", e)
+		}
+		if e.Port != 80 {
+			t.Fatalf("bad: %v", e)
+		}
+		if e.Info != "Local web server" {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
 		t.Fatalf("record not found")
 	}
 }
+
+func TestServer_QueryAll(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_queryall._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	params := &QueryParam{
+		Service:         "_queryall._tcp",
+		Domain:          "local",
+		Timeout:         50 * time.Millisecond,
+		Retries:         2,
+		AllowDuplicates: true,
+	}
+	entries, err := QueryAll(params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d: %v", len(entries), entries)
+	}
+	if e := entries[0]; e.Name != "hostname._queryall._tcp.local." || e.Port != 80 {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestServer_ResolveInstance(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_resolve._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:         "_resolve._tcp",
+		Domain:          "local",
+		Timeout:         5 * time.Second,
+		Entries:         entries,
+		ResolveInstance: "hostname",
+	}
+	start := time.Now()
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the resolve to return on completion, took %v", elapsed)
+	}
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._resolve._tcp.local." || e.Port != 80 || e.Info != "Local web server" {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestServer_ResolveService(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_resolvesvc._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	e, err := ResolveService("hostname", "_resolvesvc._tcp", "", 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if e.Name != "hostname._resolvesvc._tcp.local." || e.Port != 80 || e.Info != "Local web server" || e.AddrV4 == nil {
+		t.Fatalf("bad: %v", e)
+	}
+
+	if _, err := ResolveService("missing", "_resolvesvc._tcp", "local", 50*time.Millisecond, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown instance, got: %v", err)
+	}
+}
+
+func TestServer_RawMessages(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_raw._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	raw := make(chan *dns.Msg, 16)
+	params := &QueryParam{
+		Service:     "_raw._tcp",
+		Domain:      "local",
+		Timeout:     50 * time.Millisecond,
+		Entries:     make(chan *ServiceEntry, 4),
+		RawMessages: raw,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(raw) == 0 {
+		t.Fatalf("expected raw messages")
+	}
+	for len(raw) > 0 {
+		msg := <-raw
+		if !msg.Response || !msg.Authoritative {
+			t.Fatalf("bad: %v", msg)
+		}
+	}
+}
+
+func TestServer_CustomGroup(t *testing.T) {
+	group4 := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 15353}
+	group6 := &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 15353}
+	serv, err := NewServer(&Config{
+		Zone:      makeServiceWithServiceName(t, "_group._tcp"),
+		IPv4Group: group4,
+		IPv6Group: group6,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	// The standard group should not reach the server
+	entries, err := QueryAll(&QueryParam{
+		Service: "_group._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries on the standard group: %v", entries)
+	}
+
+	entries, err = QueryAll(&QueryParam{
+		Service:   "_group._tcp",
+		Domain:    "local",
+		Timeout:   50 * time.Millisecond,
+		IPv4Group: group4,
+		IPv6Group: group6,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "hostname._group._tcp.local." {
+		t.Fatalf("bad: %v", entries)
+	}
+}
+
+func TestServer_ResolveHost(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_host._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	addrs, err := ResolveHost("testhost", 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := map[string]bool{
+		"192.168.0.42":                         true,
+		"2620:0:1000:1900:b0c2:d0b2:c411:18bc": true,
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("bad: %v", addrs)
+	}
+	for _, addr := range addrs {
+		if !want[addr.String()] {
+			t.Fatalf("unexpected address %v in %v", addr, addrs)
+		}
+	}
+
+	if _, err := ResolveHost("missinghost", 50*time.Millisecond, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown host, got: %v", err)
+	}
+	if _, err := ResolveHost("bad..host", 50*time.Millisecond, nil); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an invalid host name, got: %v", err)
+	}
+}
+
+// reverseZone answers reverse mapping queries for the addresses of a
+// service's host
+type reverseZone struct {
+	*MDNSService
+}
+
+func (r *reverseZone) Records(q dns.Question) []dns.RR {
+	for _, ip := range r.IPs {
+		if name, _ := dns.ReverseAddr(ip.String()); q.Name == name && q.Qtype == dns.TypePTR {
+			return []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: defaultTTL},
+				Ptr: r.HostName,
+			}}
+		}
+	}
+	return r.MDNSService.Records(q)
+}
+
+func TestServer_ReverseLookup(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: &reverseZone{makeServiceWithServiceName(t, "_reverse._tcp")}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	for _, ip := range []string{"192.168.0.42", "2620:0:1000:1900:b0c2:d0b2:c411:18bc"} {
+		name, err := ReverseLookup(net.ParseIP(ip), 50*time.Millisecond, nil)
+		if err != nil {
+			t.Fatalf("%s: err: %v", ip, err)
+		}
+		if name != "testhost." {
+			t.Fatalf("%s: bad name: %q", ip, name)
+		}
+	}
+
+	if _, err := ReverseLookup(net.ParseIP("192.168.0.43"), 50*time.Millisecond, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown address, got: %v", err)
+	}
+	if _, err := ReverseLookup(nil, 50*time.Millisecond, nil); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for an invalid address, got: %v", err)
+	}
+}
+
+func TestServer_Lookup_Services(t *testing.T) {
+	for _, service := range []string{"_first._tcp", "_second._tcp"} {
+		serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, service)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer serv.Shutdown()
+	}
+
+	entries := make(chan *ServiceEntry, 8)
+	params := &QueryParam{
+		Service:  "_first._tcp",
+		Services: []string{"_second._tcp", "_absent._tcp"},
+		Domain:   "local",
+		Timeout:  50 * time.Millisecond,
+		Entries:  entries,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(entries)
+
+	found := make(map[string]string)
+	for e := range entries {
+		found[e.Name] = e.ServiceType
+	}
+	want := map[string]string{
+		"hostname._first._tcp.local.":  "_first._tcp",
+		"hostname._second._tcp.local.": "_second._tcp",
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Fatalf("got %v, want %v", found, want)
+	}
+}
+
+func TestServer_TXTRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		txt  []string
+		want map[string]string
+	}{
+		{[]string{"path=/print", "color=T", "duplex"}, map[string]string{"path": "/print", "color": "T", "duplex": ""}},
+		{nil, map[string]string{}},
+	} {
+		zone, err := NewMDNSService("hostname", "_txt._tcp", "local.", "testhost.", 80,
+			[]net.IP{net.IP([]byte{192, 168, 0, 42})}, test.txt)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		serv, err := NewServer(&Config{Zone: zone})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		entries, err := QueryAll(&QueryParam{
+			Service: "_txt._tcp",
+			Domain:  "local",
+			Timeout: 50 * time.Millisecond,
+		})
+		serv.Shutdown()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%q: expected 1 entry, got %v", test.txt, entries)
+		}
+		if got := entries[0].TXTMap(); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%q: got %v, want %v", test.txt, got, test.want)
+		}
+	}
+}
+
+func TestServer_LookupFamily(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_family._tcp")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	for name, lookup := range map[string]func(string, chan<- *ServiceEntry) error{
+		"Lookup4": Lookup4,
+		"Lookup6": Lookup6,
+	} {
+		entries := make(chan *ServiceEntry, 4)
+		if err := lookup("_family._tcp", entries); err != nil {
+			if name == "Lookup6" {
+				t.Logf("IPv6 multicast is unavailable: %v", err)
+				continue
+			}
+			t.Fatalf("%s: err: %v", name, err)
+		}
+		if name == "Lookup4" && len(entries) == 0 {
+			t.Fatalf("%s: record not found", name)
+		}
+		for len(entries) > 0 {
+			if e := <-entries; e.Name != "hostname._family._tcp.local." {
+				t.Fatalf("%s: bad: %v", name, e)
+			}
+		}
+	}
+}
+
+func TestServer_IPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.168.0.42"), net.ParseIP("10.0.0.42")}
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_ips._tcp"), IPs: ips})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	addrs, err := ResolveHost("testhost", 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) != len(ips) {
+		t.Fatalf("bad: %v", addrs)
+	}
+	for i, ip := range ips {
+		if !addrs[i].Equal(ip) {
+			t.Fatalf("bad: %v", addrs)
+		}
+	}
+}
+
+func TestServer_GoodbyeRecords_IPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.42"), net.ParseIP("2001:db8::42")}
+	s := &Server{config: &Config{Zone: makeServiceWithServiceName(t, "_bye._tcp"), IPs: ips}}
+
+	var addrs []net.IP
+	for _, rr := range s.goodbyeRecords() {
+		if rr.Header().Ttl != 0 {
+			t.Fatalf("expected a zero TTL: %v", rr)
+		}
+		if ip := addressOf(rr); ip != nil {
+			addrs = append(addrs, ip)
+		}
+	}
+
+	// The configured addresses are retracted, rather than the zone's
+	if len(addrs) != len(ips) || !addrs[0].Equal(ips[0]) || !addrs[1].Equal(ips[1]) {
+		t.Fatalf("bad: %v", addrs)
+	}
+}
+
+func TestServer_AddressRecords_LinkLocal(t *testing.T) {
+	s := &Server{
+		config:   &Config{Iface: &net.Interface{Name: "test0"}},
+		ifaceIPs: []net.IP{net.ParseIP("fe80::1")},
+	}
+	hdr := dns.RR_Header{Name: "testhost.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}
+	records := []dns.RR{
+		&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("fe80::1")},
+		&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("fe80::2")},
+		&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")},
+	}
+
+	got := s.addressRecords(records)
+	if len(got) != 2 || !addressOf(got[0]).Equal(net.ParseIP("fe80::1")) ||
+		!addressOf(got[1]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// The configured addresses are filtered too
+	s.config.IPs = []net.IP{net.ParseIP("fe80::2"), net.ParseIP("2001:db8::2"), net.ParseIP("10.0.0.1")}
+	got = s.addressRecords(records)
+	if len(got) != 1 || !addressOf(got[0]).Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("bad: %v", got)
+	}
+}
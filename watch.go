@@ -0,0 +1,172 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Watch keeps track of a single instance, such as one found by a Query,
+// given its full name like "hostname._http._tcp.local.", which
+// ServiceInstanceName builds from its parts. An entry is sent
+// to the updates channel once the instance is resolved, and again whenever
+// its host, addresses, port or TXT records change, so that a connection to
+// it can be re-established. Sends will not block, so clients should make
+// sure to either read or buffer. The returned function stops the watch.
+//
+// Only the instance's own records are asked for, which is cheaper than a
+// Browse of its whole service.
+func Watch(instance string, updates chan<- *ServiceEntry) (func(), error) {
+	params := DefaultParams("")
+	params.Entries = updates
+	if err := validateInstanceName(instance); err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		if err := client.Watch(ctx, instance, params); err != nil && err != context.Canceled {
+			params.Logger.Printf("[ERR] mdns: Watch of %s failed: %v", instance, err)
+		}
+	}()
+
+	stop := func() {
+		cancel()
+		<-doneCh
+		client.Close()
+	}
+	return stop, nil
+}
+
+// Watch is the same as the package level Watch, however it uses the
+// listeners of the client, streaming updates to the Entries channel of the
+// parameters until the context is cancelled, returning ctx.Err(). The
+// client is busy until the watch returns. The Service, Timeout and Removed
+// parameters are ignored.
+func (c *Client) Watch(ctx context.Context, instance string, params *QueryParam) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClientClosed
+	}
+	if params.Entries == nil {
+		return ErrNoEntriesChannel
+	}
+	if err := validateInstanceName(instance); err != nil {
+		return err
+	}
+
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	ctx, done := c.startQuery(ctx)
+	defer done()
+
+	if err := c.prepare(params); err != nil {
+		return err
+	}
+	return c.watch(ctx, dns.Fqdn(instance), params)
+}
+
+// validateInstanceName checks that the name of an instance to watch is a
+// valid domain name, returning an error wrapping ErrInvalidServiceName
+func validateInstanceName(instance string) error {
+	if _, ok := dns.IsDomainName(instance); !ok || instance == "" || instance == "." {
+		return fmt.Errorf("%w: %q", ErrInvalidServiceName, instance)
+	}
+	return nil
+}
+
+// watch is used to keep querying for an instance and stream its changes
+func (c *Client) watch(ctx context.Context, instance string, params *QueryParam) error {
+	// Listen until the watch is cancelled
+	msgCh, errCh, stop := c.startRecv(time.Time{}, newSourceFilter(params), params)
+	defer stop()
+
+	m := newInstanceQuery(instance, params)
+	a := newAssembler(nil, params)
+	var last *ServiceEntry
+
+	// Query with the same backoff as a browse until the instance is found,
+	// then again at 80% of the lifetime of its service record
+	queryCh := time.After(0)
+	interval := browseMinInterval
+	for {
+		select {
+		case <-queryCh:
+			if err := c.sendQuery(m, params); err != nil {
+				params.Logger.Printf("[ERR] mdns: Failed to send query: %v", err)
+			}
+			queryCh = time.After(interval)
+			if interval *= 2; interval > browseMaxInterval {
+				interval = browseMaxInterval
+			}
+
+		case pkt := <-msgCh:
+			sendRawMessage(params, pkt.msg)
+			for _, inp := range a.handleResponse(pkt) {
+				if !strings.EqualFold(inp.Name, instance) || !inp.complete() || sameEndpoint(last, inp) {
+					continue
+				}
+				entry := *inp
+				last = &entry
+				select {
+				case params.Entries <- &entry:
+				default:
+					params.Stats.countDropped()
+				}
+			}
+			if ttl, ok := instanceTTL(pkt.msg, instance); ok {
+				queryCh = time.After(browseTTL(ttl, params.MinTTL) * 8 / 10)
+				interval = browseMinInterval
+			}
+
+		case err := <-errCh:
+			// Every listener has failed, so nothing more will be received
+			return err
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// instanceTTL returns the TTL of the service record for an instance in a
+// response, if it has one that isn't a goodbye
+func instanceTTL(msg *dns.Msg, instance string) (uint32, bool) {
+	if !msg.Response {
+		return 0, false
+	}
+	for _, rr := range responseRecords(msg) {
+		if srv, ok := rr.(*dns.SRV); ok && srv.Hdr.Ttl > 0 && strings.EqualFold(srv.Hdr.Name, instance) {
+			return srv.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+// sameEndpoint checks if two entries for an instance describe the same
+// host, addresses, port and TXT records
+func sameEndpoint(a, b *ServiceEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Host != b.Host || a.Port != b.Port || !a.AddrV4.Equal(b.AddrV4) ||
+		!a.AddrV6.Equal(b.AddrV6) || a.AddrV6Zone != b.AddrV6Zone || len(a.InfoFields) != len(b.InfoFields) {
+		return false
+	}
+	for i := range a.InfoFields {
+		if a.InfoFields[i] != b.InfoFields[i] {
+			return false
+		}
+	}
+	return true
+}
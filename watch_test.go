@@ -0,0 +1,88 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// movingZone answers with a short TTL, and moves the service to another
+// port once moved is set
+type movingZone struct {
+	Zone
+	moved int32
+}
+
+func (m *movingZone) Records(q dns.Question) []dns.RR {
+	recs := m.Zone.Records(q)
+	moved := atomic.LoadInt32(&m.moved) == 1
+	for i, rr := range recs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 1
+		if srv, ok := rr.(*dns.SRV); ok && moved {
+			srv.Port++
+		}
+		recs[i] = rr
+	}
+	return recs
+}
+
+func TestWatch(t *testing.T) {
+	zone := &movingZone{Zone: makeServiceWithServiceName(t, "_watch._tcp")}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	updates := make(chan *ServiceEntry, 4)
+	stop, err := Watch("hostname._watch._tcp.local.", updates)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stop()
+
+	for _, port := range []int{80, 81} {
+		select {
+		case e := <-updates:
+			if e.Name != "hostname._watch._tcp.local." || e.Port != port {
+				t.Fatalf("bad: %v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for port %d", port)
+		}
+		atomic.StoreInt32(&zone.moved, 1)
+	}
+
+	// Answers that don't change the instance aren't streamed
+	select {
+	case e := <-updates:
+		t.Fatalf("unexpected update: %v", e)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestWatch_InvalidName(t *testing.T) {
+	if _, err := Watch("", make(chan *ServiceEntry)); !errors.Is(err, ErrInvalidServiceName) {
+		t.Fatalf("expected ErrInvalidServiceName, got: %v", err)
+	}
+}
+
+func TestClient_Watch_Cancel(t *testing.T) {
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	params := &QueryParam{Entries: make(chan *ServiceEntry, 1)}
+	if err := c.Watch(ctx, "missing._watch._tcp.local.", params); err != context.DeadlineExceeded {
+		t.Fatalf("expected the watch to run until the deadline, got: %v", err)
+	}
+}
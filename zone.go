@@ -40,12 +40,14 @@ type MDNSService struct {
 // hdomain name (more specifically, a hostname).
 func validateFQDN(s string) error {
 	if len(s) == 0 {
-		return fmt.Errorf("FQDN must not be blank")
+		return fmt.Errorf("%w: FQDN must not be blank", ErrInvalidParam)
 	}
 	if s[len(s)-1] != '.' {
-		return fmt.Errorf("FQDN must end in period: %s", s)
+		return fmt.Errorf("%w: FQDN must end in period: %s", ErrInvalidParam, s)
+	}
+	if _, ok := dns.IsDomainName(s); !ok {
+		return fmt.Errorf("%w: FQDN must have labels of 1 to 63 bytes, and be at most 255 bytes: %s", ErrInvalidParam, s)
 	}
-	// TODO(reddaly): Perform full validation.
 
 	return nil
 }
@@ -63,13 +65,13 @@ func validateFQDN(s string) error {
 func NewMDNSService(instance, service, domain, hostName string, port int, ips []net.IP, txt []string) (*MDNSService, error) {
 	// Sanity check inputs
 	if instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+		return nil, fmt.Errorf("%w: missing service instance name", ErrInvalidServiceName)
 	}
 	if service == "" {
-		return nil, fmt.Errorf("missing service name")
+		return nil, fmt.Errorf("%w: missing service name", ErrInvalidServiceName)
 	}
 	if port == 0 {
-		return nil, fmt.Errorf("missing service port")
+		return nil, fmt.Errorf("%w: missing service port", ErrInvalidParam)
 	}
 
 	// Set default domain
@@ -77,7 +79,7 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 		domain = "local."
 	}
 	if err := validateFQDN(domain); err != nil {
-		return nil, fmt.Errorf("domain %q is not a fully-qualified domain name: %v", domain, err)
+		return nil, fmt.Errorf("domain %q is not a fully-qualified domain name: %w", domain, err)
 	}
 
 	// Get host information if no host is specified.
@@ -90,7 +92,7 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 		hostName = fmt.Sprintf("%s.", hostName)
 	}
 	if err := validateFQDN(hostName); err != nil {
-		return nil, fmt.Errorf("hostName %q is not a fully-qualified domain name: %v", hostName, err)
+		return nil, fmt.Errorf("hostName %q is not a fully-qualified domain name: %w", hostName, err)
 	}
 
 	if len(ips) == 0 {
@@ -114,6 +116,11 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 		}
 	}
 
+	addr, err := instanceAddr(instance, service, domain)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MDNSService{
 		Instance:     instance,
 		Service:      service,
@@ -122,9 +129,9 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 		Port:         port,
 		IPs:          ips,
 		TXT:          txt,
-		serviceAddr:  fmt.Sprintf("%s.%s.", trimDot(service), trimDot(domain)),
-		instanceAddr: fmt.Sprintf("%s.%s.%s.", instance, trimDot(service), trimDot(domain)),
-		enumAddr:     fmt.Sprintf("_services._dns-sd._udp.%s.", trimDot(domain)),
+		serviceAddr:  joinName(service, domain),
+		instanceAddr: addr,
+		enumAddr:     joinName("_services._dns-sd._udp", domain),
 	}, nil
 }
 
@@ -133,6 +140,132 @@ func trimDot(s string) string {
 	return strings.Trim(s, ".")
 }
 
+// joinName joins the parts of a name, such as a service and its domain,
+// into a fully qualified name. The dots around each part are trimmed and
+// empty parts skipped, so that "local", "local." and ".local." are all
+// equivalent spellings of a domain.
+func joinName(parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		if part = trimDot(part); part != "" {
+			b.WriteString(part)
+			b.WriteByte('.')
+		}
+	}
+	if b.Len() == 0 {
+		return "."
+	}
+	return b.String()
+}
+
+// trimDomain removes the domain from the end of a fully qualified name,
+// ignoring case, returning the name unchanged if it is not in the domain
+func trimDomain(name, domain string) string {
+	suffix := "." + joinName(domain)
+	if n := len(name) - len(suffix); n > 0 && strings.EqualFold(name[n:], suffix) {
+		return name[:n]
+	}
+	return name
+}
+
+// escapeLabel returns a single DNS label in presentation format, escaped
+// exactly as the dns package escapes names it unpacks, so that instance
+// names compare equal to those seen on the wire. The escaping is of each
+// byte, so a label too long to unpack at once is escaped in pieces.
+func escapeLabel(label string) string {
+	var b strings.Builder
+	buf := make([]byte, 0, 65)
+	for len(label) > 0 {
+		n := len(label)
+		if n > 63 {
+			n = 63
+		}
+		buf = append(buf[:0], byte(n))
+		buf = append(buf, label[:n]...)
+		buf = append(buf, 0)
+		name, _, _ := dns.UnpackDomainName(buf, 0)
+		b.WriteString(strings.TrimSuffix(name, "."))
+		label = label[n:]
+	}
+	return b.String()
+}
+
+// instanceAddr returns the fully qualified address of a service instance
+func instanceAddr(instance, service, domain string) (string, error) {
+	if len(instance) == 0 || len(instance) > 63 {
+		return "", fmt.Errorf("invalid instance name: label must be between 1 and 63 bytes: %q", instance)
+	}
+	addr := escapeLabel(instance) + "." + joinName(service, domain)
+
+	// The records of the instance could not be packed with a longer name,
+	// so nobody would be able to find it
+	if _, ok := dns.IsDomainName(addr); !ok {
+		return "", fmt.Errorf("instance name %q is too long to advertise as %q, which exceeds 255 bytes", instance, addr)
+	}
+	return addr, nil
+}
+
+// ServiceInstanceName returns the fully qualified name of an instance of a
+// service, such as "My Printer._ipp._tcp.local.", escaping any dots or
+// other special characters in the instance. The domain defaults to
+// "local". The name is not validated: an empty instance, one longer than
+// the 63 bytes of a label, or a name over 255 bytes is rejected by
+// ParseInstanceName, NewMDNSService and queries for the instance instead.
+func ServiceInstanceName(instance, service, domain string) string {
+	if domain == "" {
+		domain = "local"
+	}
+	return escapeLabel(instance) + "." + joinName(service, domain)
+}
+
+// ParseInstanceName splits the fully qualified name of an instance, such as
+// the Name of a ServiceEntry, into the unescaped instance, the service and
+// the domain, as given to ServiceInstanceName. An error is returned if the
+// name is not an instance of a service of the form "_service._proto".
+func ParseInstanceName(name string) (instance, service, domain string, err error) {
+	buf := make([]byte, 256)
+	if _, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false); err != nil {
+		return "", "", "", fmt.Errorf("invalid instance name %q: %v", name, err)
+	}
+
+	// Read the labels from the wire format, where they are unescaped
+	var labels []string
+	for off := 0; buf[off] != 0; off += int(buf[off]) + 1 {
+		labels = append(labels, string(buf[off+1:off+1+int(buf[off])]))
+	}
+	if len(labels) < 4 || !strings.HasPrefix(labels[1], "_") ||
+		(!strings.EqualFold(labels[2], "_tcp") && !strings.EqualFold(labels[2], "_udp")) {
+		return "", "", "", fmt.Errorf("%q is not the name of a service instance", name)
+	}
+
+	// The service and domain labels are returned in presentation format
+	rest := dns.SplitDomainName(name)
+	return labels[0], rest[1] + "." + rest[2], strings.Join(rest[3:], "."), nil
+}
+
+// instance returns the instance name of the service
+func (m *MDNSService) instance() string {
+	return m.Instance
+}
+
+// probeName returns the fully qualified instance name, which must be
+// unique on the network
+func (m *MDNSService) probeName() string {
+	return m.instanceAddr
+}
+
+// rename changes the instance name of the service, after a conflict was
+// found while probing
+func (m *MDNSService) rename(instance string) error {
+	addr, err := instanceAddr(instance, m.Service, m.Domain)
+	if err != nil {
+		return err
+	}
+	m.Instance = instance
+	m.instanceAddr = addr
+	return nil
+}
+
 // Records returns DNS records in response to a DNS question.
 func (m *MDNSService) Records(q dns.Question) []dns.RR {
 	switch q.Name {
@@ -152,6 +285,14 @@ func (m *MDNSService) Records(q dns.Question) []dns.RR {
 	}
 }
 
+// announcement returns every record advertised for the service
+func (m *MDNSService) announcement() []dns.RR {
+	return m.serviceRecords(dns.Question{
+		Name:  m.serviceAddr,
+		Qtype: dns.TypePTR,
+	})
+}
+
 func (m *MDNSService) serviceEnum(q dns.Question) []dns.RR {
 	switch q.Qtype {
 	case dns.TypeANY:
@@ -292,6 +433,12 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 		return recs
 
 	case dns.TypeTXT:
+		// A TXT record with no strings is invalid, so a service without
+		// any advertises a single empty string, per section 6.1 of RFC 6763
+		strs := m.TXT
+		if len(strs) == 0 {
+			strs = []string{""}
+		}
 		txt := &dns.TXT{
 			Hdr: dns.RR_Header{
 				Name:   q.Name,
@@ -299,7 +446,7 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Class:  dns.ClassINET,
 				Ttl:    defaultTTL,
 			},
-			Txt: m.TXT,
+			Txt: strs,
 		}
 		return []dns.RR{txt}
 	}
@@ -2,8 +2,10 @@ package mdns
 
 import (
 	"bytes"
+	"errors"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -55,12 +57,25 @@ func TestNewMDNSService_BadParams(t *testing.T) {
 			80, // port
 			[]net.IP{net.IP([]byte{192, 168, 0, 42})},
 			[]string{"Local web server"}) // TXT
-		if err == nil {
-			t.Fatalf("%s: error expected, but got none", test.testName)
+		if !errors.Is(err, ErrInvalidParam) {
+			t.Fatalf("%s: expected an invalid parameter, got %v", test.testName, err)
 		}
 	}
 }
 
+func TestNewMDNSService_MissingParams(t *testing.T) {
+	ips := []net.IP{net.IP([]byte{192, 168, 0, 42})}
+	if _, err := NewMDNSService("", "_http._tcp", "local.", "testhost.", 80, ips, nil); !errors.Is(err, ErrInvalidServiceName) {
+		t.Fatalf("expected an invalid service name for a missing instance, got %v", err)
+	}
+	if _, err := NewMDNSService("instance", "", "local.", "testhost.", 80, ips, nil); !errors.Is(err, ErrInvalidServiceName) {
+		t.Fatalf("expected an invalid service name for a missing service, got %v", err)
+	}
+	if _, err := NewMDNSService("instance", "_http._tcp", "local.", "testhost.", 0, ips, nil); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected an invalid parameter for a missing port, got %v", err)
+	}
+}
+
 func TestMDNSService_BadAddr(t *testing.T) {
 	s := makeService(t)
 	q := dns.Question{
@@ -220,6 +235,18 @@ func TestMDNSService_InstanceAddr_TXT(t *testing.T) {
 	}
 }
 
+func TestMDNSService_InstanceAddr_EmptyTXT(t *testing.T) {
+	s := makeService(t)
+	s.TXT = nil
+	recs := s.Records(dns.Question{Name: "hostname._http._tcp.local.", Qtype: dns.TypeTXT})
+	if len(recs) != 1 {
+		t.Fatalf("bad: %v", recs)
+	}
+	if got, want := recs[0].(*dns.TXT).Txt, []string{""}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
 func TestMDNSService_HostNameQuery(t *testing.T) {
 	s := makeService(t)
 	for _, test := range []struct {
@@ -273,3 +300,144 @@ func TestMDNSService_serviceEnum_PTR(t *testing.T) {
 		t.Fatalf("bad PTR record %v: got %v, want %v", ptr, got, want)
 	}
 }
+
+func TestMDNSService_EscapedInstance(t *testing.T) {
+	for _, instance := range []string{
+		"Bob's Printer.local",
+		`back\slash`,
+		"Caf\u00e9 (2)",
+	} {
+		s, err := NewMDNSService(instance, "_http._tcp", "local.", "testhost.", 80,
+			[]net.IP{net.IP([]byte{192, 168, 0, 42})}, []string{"Local web server"})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The pointer target should survive a round trip over the wire
+		// unchanged, and be usable to ask for the instance's records
+		resp := new(dns.Msg)
+		resp.Answer = s.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})[:1]
+		buf, err := resp.Pack()
+		if err != nil {
+			t.Fatalf("%q: err: %v", instance, err)
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf); err != nil {
+			t.Fatalf("%q: err: %v", instance, err)
+		}
+		target := msg.Answer[0].(*dns.PTR).Ptr
+		if target != s.instanceAddr {
+			t.Fatalf("%q: got %q, want %q", instance, target, s.instanceAddr)
+		}
+		if labels := dns.CountLabel(target); labels != 4 {
+			t.Fatalf("%q: instance should be a single label: %q", instance, target)
+		}
+		if recs := s.Records(dns.Question{Name: target, Qtype: dns.TypeSRV}); len(recs) == 0 {
+			t.Fatalf("%q: no records for %q", instance, target)
+		}
+	}
+}
+
+func TestNewMDNSService_LongInstance(t *testing.T) {
+	_, err := NewMDNSService(strings.Repeat("a", 64), "_http._tcp", "local.", "testhost.", 80,
+		[]net.IP{net.IP([]byte{192, 168, 0, 42})}, nil)
+	if err == nil {
+		t.Fatalf("expected error for an instance name longer than a label")
+	}
+}
+
+func TestNewMDNSService_LongName(t *testing.T) {
+	// Each label is valid, but the instance's name is too long in total
+	service := strings.Repeat("s", 60) + "." + strings.Repeat("t", 60) + "._tcp"
+	domain := strings.Repeat("d", 60) + ".local."
+	_, err := NewMDNSService(strings.Repeat("a", 63), service, domain, "testhost.", 80,
+		[]net.IP{net.IP([]byte{192, 168, 0, 42})}, nil)
+	if err == nil || !strings.Contains(err.Error(), "255 bytes") {
+		t.Fatalf("expected error for a name longer than 255 bytes, got: %v", err)
+	}
+
+	// The same applies when renaming after a probe conflict
+	s, err := NewMDNSService("a", service, domain, "testhost.", 80,
+		[]net.IP{net.IP([]byte{192, 168, 0, 42})}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.rename(strings.Repeat("a", 63)); err == nil {
+		t.Fatalf("expected error renaming to a name longer than 255 bytes")
+	}
+	if s.Instance != "a" {
+		t.Fatalf("instance should be unchanged after a failed rename: %q", s.Instance)
+	}
+}
+
+func TestServiceInstanceName(t *testing.T) {
+	for _, test := range []struct {
+		instance, service, domain string
+		want                      string
+	}{
+		{"My Printer", "_ipp._tcp", "", `My\ Printer._ipp._tcp.local.`},
+		{"v1.2 (office)", "_http._tcp", "example.com.", `v1\.2\ \(office\)._http._tcp.example.com.`},
+	} {
+		name := ServiceInstanceName(test.instance, test.service, test.domain)
+		if name != test.want {
+			t.Fatalf("got %q, want %q", name, test.want)
+		}
+
+		// Parsing the name gives back the parts
+		instance, service, domain, err := ParseInstanceName(name)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		wantDomain := trimDot(test.domain)
+		if wantDomain == "" {
+			wantDomain = "local"
+		}
+		if instance != test.instance || service != test.service || domain != wantDomain {
+			t.Fatalf("bad: %q %q %q", instance, service, domain)
+		}
+	}
+
+	// Names that can't be advertised are left for the parser to reject
+	for _, instance := range []string{"", strings.Repeat("a.", 32)} {
+		name := ServiceInstanceName(instance, "_http._tcp", "local")
+		if _, _, _, err := ParseInstanceName(name); err == nil {
+			t.Fatalf("expected an error parsing %q", name)
+		}
+	}
+	if name := ServiceInstanceName(strings.Repeat("a.", 32), "_http._tcp", "local"); name != strings.Repeat(`a\.`, 32)+"._http._tcp.local." {
+		t.Fatalf("expected a long instance to be escaped whole, got %q", name)
+	}
+	for _, name := range []string{"testhost.local.", "_http._tcp.local.", "x.http.tcp.local.", "a..b"} {
+		if _, _, _, err := ParseInstanceName(name); err == nil {
+			t.Fatalf("expected an error parsing %q", name)
+		}
+	}
+}
+
+func TestJoinName(t *testing.T) {
+	for _, domain := range []string{"local", "local.", ".local.", "..local.."} {
+		if name := joinName("_http._tcp", domain); name != "_http._tcp.local." {
+			t.Fatalf("%q: got %q", domain, name)
+		}
+		params := &QueryParam{Service: "_http._tcp.", Domain: domain, Subtype: "_printer"}
+		if name := queryName(params); name != "_printer._sub._http._tcp.local." {
+			t.Fatalf("%q: got %q", domain, name)
+		}
+		if name := trimDomain("_http._tcp.LOCAL.", domain); name != "_http._tcp" {
+			t.Fatalf("%q: got %q", domain, name)
+		}
+		addr, err := instanceAddr("trailing.", "_http._tcp", domain)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if addr != `trailing\.._http._tcp.local.` {
+			t.Fatalf("%q: got %q", domain, addr)
+		}
+	}
+	if name := joinName("", "."); name != "." {
+		t.Fatalf("got %q", name)
+	}
+	if name := trimDomain("_http._tcp.example.", "local"); name != "_http._tcp.example." {
+		t.Fatalf("expected a name outside the domain to be unchanged, got %q", name)
+	}
+}